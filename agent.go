@@ -0,0 +1,124 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/consul/api"
+)
+
+// agentClient talks to the Consul agent on behalf of the single service
+// of the DSN. It's used by Authorizer, Registrar and ConnectCredentials
+// instead of Resolver, so only the connection parameters of the DSN
+// (address, credentials, token, timeout, TLS, wait and max-backoff) matter.
+type agentClient struct {
+	logger  Logger
+	onError func(error)
+
+	// service is the name of the service the agent is asked about.
+	service string
+	// target is the redacted DSN for the logs.
+	target     string
+	wait       time.Duration
+	maxBackoff time.Duration
+	agent      agent
+}
+
+// newAgentClient returns the client of the agent from the DSN of the single service,
+// e.g. 'consul://127.0.0.1:8500/payments'.
+func newAgentClient(dsn string, opts ...AgentOption) (*agentClient, error) {
+	t, err := ParseTarget(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.services) > 0 {
+		return nil, fmt.Errorf("%w('%s'): exactly one service without weight is expected", ErrMalformedURL, t.String())
+	}
+
+	o := agentOptions{logger: noopLogger{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	client := o.client
+	if client == nil {
+		cfg := t.consulConfig()
+		if o.tokenProvider != nil {
+			cfg = withTokenProvider(cfg, o.tokenProvider)
+		}
+
+		client, err = api.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the Consul API: %w", err)
+		}
+	}
+
+	return &agentClient{
+		logger:     o.logger,
+		onError:    func(error) {},
+		service:    t.Service,
+		target:     t.String(),
+		wait:       t.Wait,
+		maxBackoff: t.MaxBackoff,
+		agent:      client.Agent(),
+	}, nil
+}
+
+// watch runs blocking queries to the agent endpoint with backoff on
+// errors until passed context is cancelled. Fetch is expected to apply the result.
+func (c *agentClient) watch(ctx context.Context, what string, fetch func(q *api.QueryOptions) (*api.QueryMeta, error)) {
+	bck := newBackoff(c.maxBackoff)
+
+	var lastIndex uint64
+	for {
+		q := (&api.QueryOptions{WaitIndex: lastIndex, WaitTime: c.wait}).WithContext(ctx)
+
+		meta, err := fetch(q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c.logger.Errorf("[Consul resolver] Couldn't fetch %s. target={%s}; error={%v}", what, c.target, err)
+			c.onError(fmt.Errorf("failed to fetch %s: %w", what, err))
+
+			select {
+			case <-time.After(bck.NextBackOff()):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		bck.Reset()
+
+		if meta.LastIndex < lastIndex {
+			// according to https://www.consul.io/api-docs/features/blocking
+			// we should reset the index if it goes backward
+			lastIndex = 0
+		} else {
+			lastIndex = meta.LastIndex
+		}
+	}
+}
+
+// newBackoff returns backoff which never stops retrying.
+func newBackoff(maxInterval time.Duration) backoff.BackOff {
+	bck := &backoff.ExponentialBackOff{
+		InitialInterval:     10 * time.Millisecond,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		Multiplier:          2,
+		MaxInterval:         maxInterval,
+		Stop:                backoff.Stop,
+		Clock:               backoff.SystemClock,
+	}
+
+	// the start time is zero until reset, so the first
+	// NextBackOff would return Stop without it
+	bck.Reset()
+
+	return bck
+}
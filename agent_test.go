@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAgentClient(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name        string
+		dsn         string
+		expect      *agentClient
+		expectError error
+	}{
+		{
+			name: "single service",
+			dsn:  "consul://127.0.0.1:8500/payments?token=secret&wait=1m&max-backoff=5s&healthy=true",
+			expect: &agentClient{
+				service:    "payments",
+				target:     "consul://127.0.0.1:8500/payments?healthy=true&max-backoff=5s&token=xxxxx&wait=1m0s",
+				wait:       time.Minute,
+				maxBackoff: 5 * time.Second,
+			},
+		},
+		{
+			name:        "several services",
+			dsn:         "consul://127.0.0.1:8500/payments-v1,payments-v2",
+			expectError: ErrMalformedURL,
+		},
+		{
+			name:        "weighted service",
+			dsn:         "consul://127.0.0.1:8500/payments:3",
+			expectError: ErrMalformedURL,
+		},
+		{
+			name:        "malformed",
+			dsn:         "consul://127.0.0.1:8500",
+			expectError: ErrMalformedURL,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newAgentClient(tc.dsn)
+			if tc.expectError != nil {
+				require.True(t, errors.Is(err, tc.expectError), err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, got.agent)
+			require.Equal(t, tc.expect.service, got.service)
+			require.Equal(t, tc.expect.target, got.target)
+			require.Equal(t, tc.expect.wait, got.wait)
+			require.Equal(t, tc.expect.maxBackoff, got.maxBackoff)
+		})
+	}
+}
+
+func TestNewAgentClient_Options(t *testing.T) {
+	t.Parallel()
+
+	client, err := api.NewClient(&api.Config{Address: "10.0.0.1:8500"})
+	require.NoError(t, err)
+
+	got, err := newAgentClient(
+		"consul://127.0.0.1:8500/payments",
+		WithAgentLogger(grpcGlobalLogger{}),
+		WithAgentConsulClient(client),
+	)
+	require.NoError(t, err)
+	require.Equal(t, grpcGlobalLogger{}, got.logger)
+	require.Equal(t, client.Agent(), got.agent)
+}
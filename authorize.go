@@ -0,0 +1,185 @@
+package consul
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const defaultAuthorizationTTL = 10 * time.Second
+
+// Authorizer enforces Consul intentions on the Connect-native gRPC server.
+// Clients are identified by the SPIFFE ID of their Connect certificates,
+// so the server is expected to use the credentials from NewConnectCredentials.
+type Authorizer struct {
+	// TTL is how long decisions of the agent are cached, 10s if zero.
+	// It must not be changed once the interceptors are in use.
+	TTL time.Duration
+
+	c   *agentClient
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]authorization
+}
+
+// authorization is the cached decision of the agent.
+type authorization struct {
+	authorized bool
+	reason     string
+	expires    time.Time
+}
+
+// NewAuthorizer returns authorizer of the calls to the service
+// from the DSN (e.g. 'consul://127.0.0.1:8500/payments'). Only the connection parameters
+// of the DSN and the passed options are used.
+func NewAuthorizer(dsn string, opts ...AgentOption) (*Authorizer, error) {
+	c, err := newAgentClient(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authorizer{
+		c:     c,
+		now:   time.Now,
+		cache: make(map[string]authorization),
+	}, nil
+}
+
+// UnaryServerInterceptor rejects unauthorized unary calls with PermissionDenied.
+func (a *Authorizer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := a.authorize(ctx); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects unauthorized streams with PermissionDenied.
+func (a *Authorizer) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.authorize(ss.Context()); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// authorize checks intentions for the client of the call.
+func (a *Authorizer) authorize(ctx context.Context) error {
+	cert, err := peerCertificate(ctx)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if len(cert.URIs) == 0 {
+		return status.Error(codes.Unauthenticated, "client certificate has no SPIFFE ID")
+	}
+
+	params := &api.AgentAuthorizeParams{
+		Target:           a.c.service,
+		ClientCertURI:    cert.URIs[0].String(),
+		ClientCertSerial: serialNumber(cert),
+	}
+
+	auth, err := a.decide(params)
+	if err != nil {
+		a.c.logger.Errorf("[Consul resolver] Couldn't authorize '%s'. target={%s}; error={%v}", params.ClientCertURI, a.c.target, err)
+		a.c.onError(fmt.Errorf("failed to authorize '%s': %w", params.ClientCertURI, err))
+
+		return status.Error(codes.Unavailable, "authorization is unavailable")
+	}
+
+	if !auth.authorized {
+		return status.Errorf(codes.PermissionDenied, "'%s' is not authorized: %s", params.ClientCertURI, auth.reason)
+	}
+
+	return nil
+}
+
+// decide returns the cached decision or asks the agent for the fresh one.
+func (a *Authorizer) decide(params *api.AgentAuthorizeParams) (authorization, error) {
+	key := params.ClientCertURI + "|" + params.ClientCertSerial
+	now := a.now()
+
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	resp, err := a.c.agent.ConnectAuthorize(params)
+	if err != nil {
+		return authorization{}, err
+	}
+
+	auth := authorization{
+		authorized: resp.Authorized,
+		reason:     resp.Reason,
+		expires:    now.Add(a.ttl()),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for k, v := range a.cache {
+		if !now.Before(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+
+	a.cache[key] = auth
+
+	return auth, nil
+}
+
+// ttl returns how long decisions are cached.
+func (a *Authorizer) ttl() time.Duration {
+	if a.TTL > 0 {
+		return a.TTL
+	}
+
+	return defaultAuthorizationTTL
+}
+
+// peerCertificate returns the leaf TLS certificate of the client of the call.
+func peerCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errors.New("unknown peer")
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	return info.State.PeerCertificates[0], nil
+}
+
+// serialNumber formats the certificate serial number the same way as Consul does, e.g. '0a:1b'.
+func serialNumber(cert *x509.Certificate) string {
+	b := cert.SerialNumber.Bytes()
+	parts := make([]string, 0, len(b))
+	for _, v := range b {
+		parts = append(parts, fmt.Sprintf("%02x", v))
+	}
+
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func peerContext(id string) context.Context {
+	cert := &x509.Certificate{SerialNumber: big.NewInt(0x0a1b)}
+	if id != "" {
+		uri, _ := url.Parse(id)
+		cert.URIs = []*url.URL{uri}
+	}
+
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+}
+
+func TestAuthorizer_UnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	const web = "spiffe://td.consul/ns/default/dc/dc1/svc/web"
+
+	tt := []struct {
+		name       string
+		ctx        context.Context
+		authorize  func(*MockAgentMockRecorder)
+		expectCode codes.Code
+	}{
+		{
+			name: "authorized",
+			ctx:  peerContext(web),
+			authorize: func(m *MockAgentMockRecorder) {
+				m.ConnectAuthorize(&api.AgentAuthorizeParams{
+					Target:           "payments",
+					ClientCertURI:    web,
+					ClientCertSerial: "0a:1b",
+				}).Return(&api.AgentAuthorize{Authorized: true}, nil)
+			},
+			expectCode: codes.OK,
+		},
+		{
+			name: "denied",
+			ctx:  peerContext(web),
+			authorize: func(m *MockAgentMockRecorder) {
+				m.ConnectAuthorize(gomock.Any()).Return(&api.AgentAuthorize{Reason: "denied by intention"}, nil)
+			},
+			expectCode: codes.PermissionDenied,
+		},
+		{
+			name: "agent error",
+			ctx:  peerContext(web),
+			authorize: func(m *MockAgentMockRecorder) {
+				m.ConnectAuthorize(gomock.Any()).Return(nil, errors.New("connection refused"))
+			},
+			expectCode: codes.Unavailable,
+		},
+		{
+			name:       "no SPIFFE ID",
+			ctx:        peerContext(""),
+			authorize:  func(*MockAgentMockRecorder) {},
+			expectCode: codes.Unauthenticated,
+		},
+		{
+			name:       "no TLS",
+			ctx:        context.Background(),
+			authorize:  func(*MockAgentMockRecorder) {},
+			expectCode: codes.Unauthenticated,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			mockAgent := NewMockAgent(ctrl)
+			tc.authorize(mockAgent.EXPECT())
+
+			a := &Authorizer{
+				c: &agentClient{
+					logger:  noopLogger{},
+					onError: func(error) {},
+					service: "payments",
+					agent:   mockAgent,
+				},
+				TTL:   time.Minute,
+				now:   time.Now,
+				cache: make(map[string]authorization),
+			}
+
+			_, err := a.UnaryServerInterceptor()(tc.ctx, nil, &grpc.UnaryServerInfo{}, func(context.Context, interface{}) (interface{}, error) {
+				return nil, nil
+			})
+			require.Equal(t, tc.expectCode, status.Code(err))
+		})
+	}
+}
+
+func TestAuthorizer_Cache(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().ConnectAuthorize(gomock.Any()).Return(&api.AgentAuthorize{Authorized: true}, nil),
+		mockAgent.EXPECT().ConnectAuthorize(gomock.Any()).Return(&api.AgentAuthorize{Reason: "denied by intention"}, nil),
+	)
+
+	now := time.Now()
+	a := &Authorizer{
+		c: &agentClient{
+			logger:  noopLogger{},
+			onError: func(error) {},
+			service: "payments",
+			agent:   mockAgent,
+		},
+		TTL:   time.Minute,
+		now:   func() time.Time { return now },
+		cache: make(map[string]authorization),
+	}
+
+	ctx := peerContext("spiffe://td.consul/ns/default/dc/dc1/svc/web")
+	require.NoError(t, a.authorize(ctx))
+	require.NoError(t, a.authorize(ctx), "cached decision is used")
+
+	now = now.Add(time.Minute)
+	require.Equal(t, codes.PermissionDenied, status.Code(a.authorize(ctx)))
+}
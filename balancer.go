@@ -0,0 +1,110 @@
+package consul
+
+import (
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// WeightedBalancerName is the name of the balancer which splits calls
+// between the services of the target according to their weights, e.g.
+// 'payments-v1,payments-v2:3' sends a quarter of calls to payments-v1.
+// Calls are spread evenly among the instances of the same service.
+// The resolver selects it by the service config for the targets
+// of several services.
+const WeightedBalancerName = "consul_weighted"
+
+// weightedServiceConfig selects the weighted balancer.
+const weightedServiceConfig = `{"loadBalancingConfig":[{"` + WeightedBalancerName + `":{}}]}`
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(WeightedBalancerName, weightedPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type weightedPickerBuilder struct{}
+
+// Build groups ready SubConns by the services of their addresses.
+// Addresses without weight make up the group of weight 1.
+func (weightedPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	byService := make(map[string]*weightedGroup)
+	addrs := make(map[balancer.SubConn]string, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		service, _ := sci.Address.BalancerAttributes.Value(serviceKey{}).(string)
+		weight, ok := Weight(sci.Address)
+		if !ok {
+			weight = 1
+		}
+
+		g, ok := byService[service]
+		if !ok {
+			g = &weightedGroup{service: service, weight: weight}
+			byService[service] = g
+		}
+
+		g.subConns = append(g.subConns, sc)
+		addrs[sc] = sci.Address.Addr
+	}
+
+	p := &weightedPicker{groups: make([]*weightedGroup, 0, len(byService))}
+	for _, g := range byService {
+		sort.Slice(g.subConns, func(i, j int) bool {
+			return addrs[g.subConns[i]] < addrs[g.subConns[j]]
+		})
+
+		p.groups = append(p.groups, g)
+		p.total += g.weight
+	}
+
+	sort.Slice(p.groups, func(i, j int) bool {
+		return p.groups[i].service < p.groups[j].service
+	})
+
+	return p
+}
+
+// weightedGroup is the ready SubConns of the single service.
+type weightedGroup struct {
+	service  string
+	weight   int
+	subConns []balancer.SubConn
+
+	// current is the state of the smooth weighted round robin
+	current int
+	// next is the index of the SubConn picked next within the group
+	next int
+}
+
+// weightedPicker picks the service by smooth weighted round robin,
+// as nginx does, and the SubConn of the service by round robin.
+type weightedPicker struct {
+	total int
+
+	mu     sync.Mutex
+	groups []*weightedGroup
+}
+
+func (p *weightedPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *weightedGroup
+	for _, g := range p.groups {
+		g.current += g.weight
+		if best == nil || g.current > best.current {
+			best = g
+		}
+	}
+
+	best.current -= p.total
+
+	sc := best.subConns[best.next]
+	best.next = (best.next + 1) % len(best.subConns)
+
+	return balancer.PickResult{SubConn: sc}, nil
+}
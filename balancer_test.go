@@ -0,0 +1,186 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mbobakov/grpc-consul-resolver/consultest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+// testSubConn is the balancer.SubConn identified by its address.
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+func TestWeightedPicker(t *testing.T) {
+	t.Parallel()
+
+	endpoint := func(addr, service string, weight int) resolver.Address {
+		return Endpoint{
+			Addr:   addr,
+			Entry:  &api.ServiceEntry{Service: &api.AgentService{Service: service}},
+			Weight: weight,
+		}.address()
+	}
+
+	tt := []struct {
+		name   string
+		addrs  []resolver.Address
+		picks  int
+		expect map[string]int
+	}{
+		{
+			name: "split between services",
+			addrs: []resolver.Address{
+				endpoint("127.0.0.1:1", "v1", 1),
+				endpoint("127.0.0.2:1", "v2", 3),
+			},
+			picks:  8,
+			expect: map[string]int{"127.0.0.1:1": 2, "127.0.0.2:1": 6},
+		},
+		{
+			name: "instances of the service share its weight",
+			addrs: []resolver.Address{
+				endpoint("127.0.0.1:1", "v1", 1),
+				endpoint("127.0.0.2:1", "v2", 1),
+				endpoint("127.0.0.3:1", "v2", 1),
+			},
+			picks:  8,
+			expect: map[string]int{"127.0.0.1:1": 4, "127.0.0.2:1": 2, "127.0.0.3:1": 2},
+		},
+		{
+			name:   "without weights",
+			addrs:  []resolver.Address{{Addr: "127.0.0.1:1"}, {Addr: "127.0.0.2:1"}},
+			picks:  4,
+			expect: map[string]int{"127.0.0.1:1": 2, "127.0.0.2:1": 2},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo, len(tc.addrs))}
+			for _, a := range tc.addrs {
+				info.ReadySCs[&testSubConn{addr: a.Addr}] = base.SubConnInfo{Address: a}
+			}
+
+			p := weightedPickerBuilder{}.Build(info)
+
+			got := make(map[string]int, len(tc.expect))
+			for i := 0; i < tc.picks; i++ {
+				res, err := p.Pick(balancer.PickInfo{})
+				require.NoError(t, err)
+
+				got[res.SubConn.(*testSubConn).addr]++
+			}
+
+			require.Equal(t, tc.expect, got)
+		})
+	}
+}
+
+func TestWeightedPicker_NoSubConns(t *testing.T) {
+	t.Parallel()
+
+	_, err := weightedPickerBuilder{}.Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{})
+	require.ErrorIs(t, err, balancer.ErrNoSubConnAvailable)
+}
+
+func TestWeightedBalancer_EndToEnd(t *testing.T) {
+	t.Parallel()
+
+	srv := consultest.NewServer()
+	t.Cleanup(srv.Close)
+
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int)
+	)
+
+	for i, service := range []string{"payments-v1", "payments-v2"} {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		service := service
+		s := grpc.NewServer(grpc.UnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			_ *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			mu.Lock()
+			calls[service]++
+			mu.Unlock()
+
+			return handler(ctx, req)
+		}))
+		healthpb.RegisterHealthServer(s, health.NewServer())
+		go s.Serve(lis) //nolint:errcheck
+		t.Cleanup(s.Stop)
+
+		srv.Register(&api.ServiceEntry{Service: &api.AgentService{
+			ID:      fmt.Sprintf("%s-%d", service, i),
+			Service: service,
+			Address: "127.0.0.1",
+			Port:    lis.Addr().(*net.TCPAddr).Port,
+		}})
+	}
+
+	conn, err := grpc.Dial(
+		"consul://"+srv.Addr()+"/payments-v1,payments-v2:3",
+		grpc.WithResolvers(NewBuilder()),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client := healthpb.NewHealthClient(conn)
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err)
+	}
+
+	// the picker is rebuilt once both of the SubConns are ready
+	require.Eventually(t, func() bool {
+		check()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(calls) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	calls = make(map[string]int)
+	mu.Unlock()
+
+	for i := 0; i < 400; i++ {
+		check()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// a quarter of calls goes to payments-v1
+	require.InDelta(t, 100, calls["payments-v1"], 4)
+	require.InDelta(t, 300, calls["payments-v2"], 4)
+}
@@ -0,0 +1,80 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// Sources of the instances. The health API is used by default, the catalog one
+// suits services registered without checks, e.g. by external registration,
+// and saves Consul servers from the evaluation of the checks.
+const (
+	sourceHealth  = "health"
+	sourceCatalog = "catalog"
+)
+
+// fetchCatalog queries the catalog for the service endpoints.
+func (r *Resolver) fetchCatalog(service string, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	var (
+		services []*api.CatalogService
+		meta     *api.QueryMeta
+		err      error
+	)
+
+	if r.t.Connect {
+		services, meta, err = r.cat.ConnectMultipleTags(service, r.t.tags, q)
+	} else {
+		services, meta, err = r.cat.ServiceMultipleTags(service, r.t.tags, q)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]*api.ServiceEntry, 0, len(services))
+	for _, s := range services {
+		entries = append(entries, catalogEntry(s))
+	}
+
+	return entries, meta, nil
+}
+
+// catalogEntry converts the catalog instance into the health one, so the
+// rest of the pipeline doesn't depend on the source of the instances.
+func catalogEntry(s *api.CatalogService) *api.ServiceEntry {
+	kind := api.ServiceKindTypical
+	// the catalog doesn't return the kind, but only proxies have the destination
+	if s.ServiceProxy != nil && s.ServiceProxy.DestinationServiceName != "" {
+		kind = api.ServiceKindConnectProxy
+	}
+
+	return &api.ServiceEntry{
+		Node: &api.Node{
+			ID:              s.ID,
+			Node:            s.Node,
+			Address:         s.Address,
+			Datacenter:      s.Datacenter,
+			TaggedAddresses: s.TaggedAddresses,
+			Meta:            s.NodeMeta,
+			Partition:       s.Partition,
+		},
+		Service: &api.AgentService{
+			Kind:              kind,
+			ID:                s.ServiceID,
+			Service:           s.ServiceName,
+			Tags:              s.ServiceTags,
+			Meta:              s.ServiceMeta,
+			Port:              s.ServicePort,
+			Address:           s.ServiceAddress,
+			TaggedAddresses:   s.ServiceTaggedAddresses,
+			Weights:           api.AgentWeights{Passing: s.ServiceWeights.Passing, Warning: s.ServiceWeights.Warning},
+			EnableTagOverride: s.ServiceEnableTagOverride,
+			CreateIndex:       s.CreateIndex,
+			ModifyIndex:       s.ModifyIndex,
+			Proxy:             s.ServiceProxy,
+			Namespace:         s.Namespace,
+			Partition:         s.Partition,
+			Datacenter:        s.Datacenter,
+		},
+		Checks: s.Checks,
+	}
+}
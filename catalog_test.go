@@ -0,0 +1,147 @@
+package consul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/mbobakov/grpc-consul-resolver/consultest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogEntry(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name   string
+		in     *api.CatalogService
+		expect *api.ServiceEntry
+	}{
+		{
+			name: "typical",
+			in: &api.CatalogService{
+				ID:             "node-id",
+				Node:           "node-1",
+				Address:        "10.0.0.1",
+				Datacenter:     "dc1",
+				NodeMeta:       map[string]string{"zone": "a"},
+				ServiceID:      "payments-1",
+				ServiceName:    "payments",
+				ServiceAddress: "10.0.1.1",
+				ServiceTags:    []string{"green"},
+				ServiceMeta:    map[string]string{"version": "1"},
+				ServicePort:    8080,
+				ServiceWeights: api.Weights{Passing: 3, Warning: 1},
+			},
+			expect: &api.ServiceEntry{
+				Node: &api.Node{
+					ID:         "node-id",
+					Node:       "node-1",
+					Address:    "10.0.0.1",
+					Datacenter: "dc1",
+					Meta:       map[string]string{"zone": "a"},
+				},
+				Service: &api.AgentService{
+					ID:         "payments-1",
+					Service:    "payments",
+					Address:    "10.0.1.1",
+					Tags:       []string{"green"},
+					Meta:       map[string]string{"version": "1"},
+					Port:       8080,
+					Weights:    api.AgentWeights{Passing: 3, Warning: 1},
+					Datacenter: "dc1",
+				},
+			},
+		},
+		{
+			name: "sidecar proxy",
+			in: &api.CatalogService{
+				Node:         "node-1",
+				Address:      "10.0.0.1",
+				ServiceID:    "payments-sidecar-proxy",
+				ServiceName:  "payments-sidecar-proxy",
+				ServicePort:  21000,
+				ServiceProxy: &api.AgentServiceConnectProxyConfig{DestinationServiceName: "payments"},
+			},
+			expect: &api.ServiceEntry{
+				Node: &api.Node{Node: "node-1", Address: "10.0.0.1"},
+				Service: &api.AgentService{
+					Kind:    api.ServiceKindConnectProxy,
+					ID:      "payments-sidecar-proxy",
+					Service: "payments-sidecar-proxy",
+					Port:    21000,
+					Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "payments"},
+				},
+			},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.expect, catalogEntry(tc.in))
+		})
+	}
+}
+
+func TestResolver_LookupCatalog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockCatalog := NewMockCatalog(ctrl)
+	mockCatalog.EXPECT().ServiceMultipleTags("svc", []string{"green"}, gomock.Any()).Return([]*api.CatalogService{
+		{Node: "node-2", ServiceAddress: "10.0.0.2", ServiceID: "svc-2", ServiceName: "svc", ServicePort: 8080},
+		{Node: "node-1", ServiceAddress: "10.0.0.1", ServiceID: "svc-1", ServiceName: "svc", ServicePort: 8080},
+		{Node: "node-3", ServiceAddress: "10.0.0.3", ServiceID: "svc-3", ServiceName: "svc", ServicePort: 8080},
+	}, &api.QueryMeta{LastIndex: 1}, nil)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Source:  sourceCatalog,
+			tags:    []string{"green"},
+			Limit:   2,
+		},
+		cat: mockCatalog,
+	}
+
+	got, err := s.Lookup(context.Background())
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, "10.0.0.1:8080", got[0].Addr)
+	require.Equal(t, "10.0.0.2:8080", got[1].Addr)
+}
+
+func TestResolver_WatchCatalog(t *testing.T) {
+	srv := consultest.NewServer()
+	t.Cleanup(srv.Close)
+
+	// catalog ignores checks, so the critical instance is resolved too
+	srv.Register(&api.ServiceEntry{
+		Service: &api.AgentService{ID: "svc-1", Service: "svc", Address: "127.0.0.1", Port: 50051},
+		Checks:  api.HealthChecks{{CheckID: "grpc", Status: api.HealthCritical}},
+	})
+
+	r, err := NewResolver("consul://" + srv.Addr() + "/svc?source=catalog&wait=1s")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := r.WatchEndpoints(ctx)
+
+	got := <-updates
+	require.Len(t, got, 1)
+	require.Equal(t, "127.0.0.1:50051", got[0].Addr)
+
+	srv.Register(&api.ServiceEntry{Service: &api.AgentService{ID: "svc-2", Service: "svc", Address: "127.0.0.2", Port: 50051}})
+
+	got = <-updates
+	require.Len(t, got, 2)
+	require.Equal(t, srv.Index(), r.State().Services["svc"].LastIndex)
+}
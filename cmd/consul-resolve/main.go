@@ -0,0 +1,282 @@
+// Command consul-resolve prints what the resolver hands to gRPC for the DSN.
+//
+// Usage:
+//
+//	consul-resolve [-watch] [-json] [-timeout 10s] 'consul://127.0.0.1:8500/whoami?healthy=true'
+//
+// Without -watch the endpoints are resolved once. With -watch every update
+// is printed as a diff against the previous one until interrupted.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	consul "github.com/mbobakov/grpc-consul-resolver"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// endpoint is the printed view of the resolved address.
+type endpoint struct {
+	Addr      string `json:"addr"`
+	Node      string `json:"node,omitempty"`
+	ServiceID string `json:"service_id,omitempty"`
+	Draining  bool   `json:"draining,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	RTT       string `json:"rtt,omitempty"`
+	Identity  string `json:"identity,omitempty"`
+}
+
+func (e endpoint) String() string {
+	var b strings.Builder
+	b.WriteString(e.Addr)
+
+	attr := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, " %s=%s", k, v)
+		}
+	}
+
+	attr("node", e.Node)
+	attr("id", e.ServiceID)
+
+	if e.Draining {
+		attr("draining", "true")
+	}
+
+	if e.Weight > 0 {
+		attr("weight", fmt.Sprint(e.Weight))
+	}
+
+	attr("rtt", e.RTT)
+	attr("identity", e.Identity)
+
+	return b.String()
+}
+
+// update is the printed result of the single resolution.
+type update struct {
+	Time      time.Time                      `json:"time"`
+	Took      string                         `json:"took"`
+	Services  map[string]consul.ServiceState `json:"services"`
+	Endpoints []endpoint                     `json:"endpoints"`
+	Added     []endpoint                     `json:"added,omitempty"`
+	Removed   []endpoint                     `json:"removed,omitempty"`
+	Changed   []endpoint                     `json:"changed,omitempty"`
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("consul-resolve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	var (
+		watch   = fs.Bool("watch", false, "print every update as a diff until interrupted")
+		asJSON  = fs.Bool("json", false, "print updates as JSON lines")
+		timeout = fs.Duration("timeout", 10*time.Second, "timeout of the single resolution")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: consul-resolve [flags] DSN")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one DSN is expected")
+	}
+
+	tgt, err := consul.ParseTarget(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r, err := consul.NewResolver(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	printUpdate := printText
+	if *asJSON {
+		printUpdate = printJSON
+	} else {
+		fmt.Fprintf(stdout, "# %s\n", tgt.String())
+	}
+
+	if !*watch {
+		lookupCtx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		start := time.Now()
+
+		endpoints, err := r.Lookup(lookupCtx)
+		if err != nil {
+			return err
+		}
+
+		return printUpdate(stdout, newUpdate(r, time.Since(start), nil, endpoints), false)
+	}
+
+	var (
+		prev  []consul.Endpoint
+		first = true
+		start = time.Now()
+	)
+
+	for endpoints := range r.WatchEndpoints(ctx) {
+		u := newUpdate(r, time.Since(start), prev, endpoints)
+		if err := printUpdate(stdout, u, !first); err != nil {
+			return err
+		}
+
+		prev, first, start = endpoints, false, time.Now()
+	}
+
+	return nil
+}
+
+// newUpdate describes the endpoints and their difference from prev.
+func newUpdate(r *consul.Resolver, took time.Duration, prev, cur []consul.Endpoint) update {
+	u := update{
+		Time:      time.Now(),
+		Took:      took.Round(time.Microsecond).String(),
+		Services:  r.State().Services,
+		Endpoints: make([]endpoint, 0, len(cur)),
+	}
+
+	before := make(map[string]endpoint, len(prev))
+	for _, e := range prev {
+		before[e.Addr] = newEndpoint(e)
+	}
+
+	after := make(map[string]bool, len(cur))
+	for _, e := range cur {
+		view := newEndpoint(e)
+		u.Endpoints = append(u.Endpoints, view)
+		after[e.Addr] = true
+
+		old, ok := before[e.Addr]
+		switch {
+		case !ok:
+			u.Added = append(u.Added, view)
+		case old != view:
+			u.Changed = append(u.Changed, view)
+		}
+	}
+
+	for _, e := range prev {
+		if !after[e.Addr] {
+			u.Removed = append(u.Removed, before[e.Addr])
+		}
+	}
+
+	return u
+}
+
+func newEndpoint(e consul.Endpoint) endpoint {
+	view := endpoint{
+		Addr:     e.Addr,
+		Draining: e.Draining,
+		Weight:   e.Weight,
+		Identity: e.Identity,
+	}
+
+	if e.Entry != nil && e.Entry.Node != nil {
+		view.Node = e.Entry.Node.Node
+	}
+
+	if e.Entry != nil && e.Entry.Service != nil {
+		view.ServiceID = e.Entry.Service.ID
+	}
+
+	if e.RTT > 0 {
+		view.RTT = e.RTT.String()
+	}
+
+	return view
+}
+
+func printJSON(w io.Writer, u update, _ bool) error {
+	return json.NewEncoder(w).Encode(u)
+}
+
+// printText prints the whole list for the first update and the diff for the following ones.
+func printText(w io.Writer, u update, diff bool) error {
+	names := make([]string, 0, len(u.Services))
+	for name := range u.Services {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	queries := make([]string, 0, len(names))
+	for _, name := range names {
+		s := u.Services[name]
+		queries = append(queries, fmt.Sprintf("%s@%d (%s)", name, s.LastIndex, s.RequestTime))
+	}
+
+	fmt.Fprintf(w, "@ %s took %s, %d endpoints, index %s\n",
+		u.Time.Format(time.RFC3339),
+		u.Took,
+		len(u.Endpoints),
+		strings.Join(queries, ", "),
+	)
+
+	for _, name := range names {
+		excluded := u.Services[name].Excluded
+
+		ids := make([]string, 0, len(excluded))
+		for id := range excluded {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			fmt.Fprintf(w, "! %s excluded: %s\n", id, excluded[id])
+		}
+	}
+
+	if !diff {
+		for _, e := range u.Endpoints {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+
+		return nil
+	}
+
+	for _, e := range u.Added {
+		fmt.Fprintf(w, "+ %s\n", e)
+	}
+
+	for _, e := range u.Removed {
+		fmt.Fprintf(w, "- %s\n", e)
+	}
+
+	for _, e := range u.Changed {
+		fmt.Fprintf(w, "~ %s\n", e)
+	}
+
+	return nil
+}
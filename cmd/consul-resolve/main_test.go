@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/mbobakov/grpc-consul-resolver/consultest"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is the buffer safe for the concurrent write and read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func newTestServer(t *testing.T) *consultest.Server {
+	t.Helper()
+
+	srv := consultest.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.Register(&api.ServiceEntry{Service: &api.AgentService{ID: "svc-1", Service: "svc", Address: "127.0.0.1", Port: 50051}})
+	srv.Register(&api.ServiceEntry{
+		Node:    &api.Node{Node: "node-2", Address: "127.0.0.9"},
+		Service: &api.AgentService{ID: "svc-9", Service: "svc", Address: "127.0.0.9", Port: 50051},
+		Checks:  api.HealthChecks{{CheckID: "_service_maintenance:svc-9", Status: api.HealthCritical, Notes: "migration"}},
+	})
+
+	return srv
+}
+
+func TestRun_Once(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t)
+
+	var out bytes.Buffer
+	err := run(context.Background(), []string{"consul://" + srv.Addr() + "/svc?token=secret"}, &out, &out)
+	require.NoError(t, err)
+
+	text := out.String()
+	require.NotContains(t, text, "secret")
+	require.Contains(t, text, "127.0.0.1:50051 node="+consultest.DefaultNode+" id=svc-1")
+	require.Contains(t, text, "1 endpoints, index svc@")
+	require.Contains(t, text, "! node-2/svc-9 excluded: service maintenance: migration")
+}
+
+func TestRun_JSON(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t)
+
+	var out bytes.Buffer
+	err := run(context.Background(), []string{"-json", "consul://" + srv.Addr() + "/svc"}, &out, &out)
+	require.NoError(t, err)
+
+	var u update
+	require.NoError(t, json.Unmarshal(out.Bytes(), &u))
+	require.Equal(t, []endpoint{{Addr: "127.0.0.1:50051", Node: consultest.DefaultNode, ServiceID: "svc-1"}}, u.Endpoints)
+	require.Equal(t, srv.Index(), u.Services["svc"].LastIndex)
+	require.Equal(t, 2, u.Services["svc"].Instances)
+	require.Equal(t, map[string]string{"node-2/svc-9": "service maintenance: migration"}, u.Services["svc"].Excluded)
+}
+
+func TestRun_Watch(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{"-watch", "consul://" + srv.Addr() + "/svc?wait=1s"}, &out, &out)
+	}()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "  127.0.0.1:50051")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	srv.Register(&api.ServiceEntry{Service: &api.AgentService{ID: "svc-2", Service: "svc", Address: "127.0.0.2", Port: 50051}})
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "+ 127.0.0.2:50051")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	srv.Deregister(consultest.DefaultNode, "svc-1")
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "- 127.0.0.1:50051")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch hasn't stopped")
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name string
+		args []string
+	}{
+		{name: "no DSN"},
+		{name: "many DSNs", args: []string{"consul://a/svc", "consul://b/svc"}},
+		{name: "malformed DSN", args: []string{"consul://a/svc?healthy=maybe"}},
+		{name: "unknown flag", args: []string{"-unknown", "consul://a/svc"}},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out bytes.Buffer
+			require.Error(t, run(context.Background(), tc.args, &out, &out))
+		})
+	}
+}
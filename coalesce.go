@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// coalesce forwards endpoints from in into the returned channel.
+// The first value is forwarded immediately. The next ones are held until
+// no new value comes within the window, but not longer than maxDelay
+// since the first held one, and only the latest of them is forwarded.
+func coalesce(
+	ctx context.Context,
+	in <-chan []*api.ServiceEntry,
+	window, maxDelay time.Duration,
+) <-chan []*api.ServiceEntry {
+	out := make(chan []*api.ServiceEntry, 1)
+
+	go func() {
+		defer close(out)
+
+		var (
+			first    = true
+			latest   []*api.ServiceEntry
+			deadline time.Time
+			fire     <-chan time.Time
+		)
+
+		send := func(v []*api.ServiceEntry) bool {
+			select {
+			case out <- v:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+
+				if first {
+					first = false
+					if !send(v) {
+						return
+					}
+
+					continue
+				}
+
+				latest = v
+
+				now := time.Now()
+				if deadline.IsZero() {
+					deadline = now.Add(maxDelay)
+				}
+
+				wait := window
+				if left := deadline.Sub(now); left < wait {
+					wait = left
+				}
+
+				fire = time.After(wait)
+			case <-fire:
+				if !send(latest) {
+					return
+				}
+
+				latest, deadline, fire = nil, time.Time{}, nil
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,103 @@
+package consul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+
+	entries := func(port int) []*api.ServiceEntry {
+		return []*api.ServiceEntry{{Service: &api.AgentService{Address: "127.0.0.1", Port: port}}}
+	}
+
+	receive := func(t *testing.T, out <-chan []*api.ServiceEntry, within time.Duration) []*api.ServiceEntry {
+		t.Helper()
+
+		select {
+		case got := <-out:
+			return got
+		case <-time.After(within):
+			t.Fatal("nothing has been received")
+			return nil
+		}
+	}
+
+	t.Run("first immediately, burst as latest", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		in := make(chan []*api.ServiceEntry)
+		out := coalesce(ctx, in, 50*time.Millisecond, time.Second)
+
+		in <- entries(1)
+		require.Equal(t, entries(1), receive(t, out, 10*time.Millisecond))
+
+		in <- entries(2)
+		in <- entries(3)
+		in <- entries(4)
+
+		select {
+		case <-out:
+			t.Fatal("burst must be held until the window ends")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		require.Equal(t, entries(4), receive(t, out, time.Second))
+	})
+
+	t.Run("max delay", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		in := make(chan []*api.ServiceEntry)
+		out := coalesce(ctx, in, 50*time.Millisecond, 100*time.Millisecond)
+
+		in <- entries(1)
+		require.Equal(t, entries(1), receive(t, out, 10*time.Millisecond))
+
+		start := time.Now()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			// updates come more often than the window
+			for i := 2; i < 20; i++ {
+				select {
+				case in <- entries(i):
+				case <-ctx.Done():
+					return
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		got := receive(t, out, time.Second)
+		require.Less(t, time.Since(start), 150*time.Millisecond)
+		require.NotEqual(t, entries(19), got)
+
+		cancel()
+		<-done
+	})
+
+	t.Run("closed input", func(t *testing.T) {
+		t.Parallel()
+
+		in := make(chan []*api.ServiceEntry)
+		out := coalesce(context.Background(), in, time.Second, time.Second)
+		close(in)
+
+		_, ok := <-out
+		require.False(t, ok)
+	})
+}
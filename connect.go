@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+const defaultNamespace = "default"
+
+// serviceName returns the name of the service the entry belongs to.
+// Sidecar proxies belong to their destination service.
+func serviceName(e *api.ServiceEntry) string {
+	if e.Service.Kind == api.ServiceKindConnectProxy && e.Service.Proxy != nil {
+		return e.Service.Proxy.DestinationServiceName
+	}
+
+	return e.Service.Service
+}
+
+// spiffeID returns the SPIFFE ID of the service the entry belongs to.
+// It's the URI SAN of the Connect leaf certificate of the service.
+func spiffeID(trustDomain string, e *api.ServiceEntry) string {
+	ns := e.Service.Namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+
+	var dc string
+	if e.Node != nil {
+		dc = e.Node.Datacenter
+	}
+
+	var partition string
+	if p := e.Service.Partition; p != "" && p != defaultNamespace {
+		partition = "/ap/" + p
+	}
+
+	return fmt.Sprintf("spiffe://%s%s/ns/%s/dc/%s/svc/%s", trustDomain, partition, ns, dc, serviceName(e))
+}
+
+// trustDomain returns the trust domain of the Connect CA. It's cached after the first success.
+func (r *Resolver) trustDomain() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.trustDomainName != "" {
+		return r.trustDomainName, nil
+	}
+
+	roots, _, err := r.agent.ConnectCARoots(nil)
+	if err != nil {
+		return "", err
+	}
+
+	if roots.TrustDomain == "" {
+		return "", errors.New("trust domain is unknown, is Connect enabled?")
+	}
+
+	r.trustDomainName = roots.TrustDomain
+
+	return r.trustDomainName, nil
+}
+
+// discoverTrustDomain fetches the trust domain of the Connect CA retrying with backoff.
+// It returns false if passed context is cancelled before the trust domain is known.
+func (r *Resolver) discoverTrustDomain(ctx context.Context, bck backoff.BackOff) bool {
+	defer bck.Reset()
+
+	for {
+		_, err := r.trustDomain()
+		if err == nil {
+			return true
+		}
+
+		r.logger.Errorf("[Consul resolver] Couldn't get Connect trust domain. target={%s}; error={%v}", r.t.String(), err)
+		r.onError(fmt.Errorf("failed to get Connect trust domain: %w", err))
+
+		select {
+		case <-time.After(bck.NextBackOff()):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+type identityKey struct{}
+
+// Identity returns the SPIFFE ID expected from the server at the address.
+// It's known only for the targets with connect=true.
+func Identity(addr resolver.Address) (string, bool) {
+	id, ok := addr.Attributes.Value(identityKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,112 @@
+package consul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpiffeID(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name   string
+		in     *api.ServiceEntry
+		expect string
+	}{
+		{
+			name: "native",
+			in: &api.ServiceEntry{
+				Node:    &api.Node{Datacenter: "dc1"},
+				Service: &api.AgentService{Service: "payments", Connect: &api.AgentServiceConnect{Native: true}},
+			},
+			expect: "spiffe://11111111-2222.consul/ns/default/dc/dc1/svc/payments",
+		},
+		{
+			name: "sidecar proxy",
+			in: &api.ServiceEntry{
+				Node: &api.Node{Datacenter: "dc1"},
+				Service: &api.AgentService{
+					Kind:    api.ServiceKindConnectProxy,
+					Service: "payments-sidecar-proxy",
+					Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "payments"},
+				},
+			},
+			expect: "spiffe://11111111-2222.consul/ns/default/dc/dc1/svc/payments",
+		},
+		{
+			name: "namespace and partition",
+			in: &api.ServiceEntry{
+				Node:    &api.Node{Datacenter: "dc2"},
+				Service: &api.AgentService{Service: "payments", Namespace: "billing", Partition: "eu"},
+			},
+			expect: "spiffe://11111111-2222.consul/ap/eu/ns/billing/dc/dc2/svc/payments",
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.expect, spiffeID("11111111-2222.consul", tc.in))
+		})
+	}
+}
+
+func TestResolver_LookupConnect(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	proxy := &api.ServiceEntry{
+		Node: &api.Node{Node: "node-1", Address: "10.0.0.1", Datacenter: "dc1"},
+		Service: &api.AgentService{
+			Kind:    api.ServiceKindConnectProxy,
+			Service: "payments-sidecar-proxy",
+			Port:    21000,
+			Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "payments"},
+		},
+	}
+	native := &api.ServiceEntry{
+		Node: &api.Node{Node: "node-2", Address: "10.0.0.2", Datacenter: "dc1"},
+		Service: &api.AgentService{
+			Service: "payments",
+			Address: "10.0.1.2",
+			Port:    8443,
+			Connect: &api.AgentServiceConnect{Native: true},
+		},
+	}
+
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ConnectMultipleTags("payments", nil, false, gomock.Any()).
+		Return([]*api.ServiceEntry{native, proxy}, &api.QueryMeta{LastIndex: 1}, nil)
+
+	mockAgent := NewMockAgent(ctrl)
+	mockAgent.EXPECT().ConnectCARoots(nil).Return(&api.CARootList{TrustDomain: "td.consul"}, nil, nil)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "payments",
+			Healthy: true,
+			Connect: true,
+		},
+		c:     mockConsul,
+		agent: mockAgent,
+	}
+
+	got, err := s.Lookup(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Endpoint{
+		{Addr: "10.0.0.1:21000", Entry: proxy, Identity: "spiffe://td.consul/ns/default/dc/dc1/svc/payments"},
+		{Addr: "10.0.1.2:8443", Entry: native, Identity: "spiffe://td.consul/ns/default/dc/dc1/svc/payments"},
+	}, got)
+
+	id, ok := Identity(got[0].address())
+	require.True(t, ok)
+	require.Equal(t, "spiffe://td.consul/ns/default/dc/dc1/svc/payments", id)
+}
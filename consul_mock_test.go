@@ -49,3 +49,255 @@ func (mr *MockConsulMockRecorder) ServiceMultipleTags(service, tags, passingOnly
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ServiceMultipleTags", reflect.TypeOf((*MockConsul)(nil).ServiceMultipleTags), service, tags, passingOnly, q)
 }
+
+// ConnectMultipleTags mocks base method.
+func (m *MockConsul) ConnectMultipleTags(service string, tags []string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectMultipleTags", service, tags, passingOnly, q)
+	ret0, _ := ret[0].([]*api.ServiceEntry)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ConnectMultipleTags indicates an expected call of ConnectMultipleTags.
+func (mr *MockConsulMockRecorder) ConnectMultipleTags(service, tags, passingOnly, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectMultipleTags", reflect.TypeOf((*MockConsul)(nil).ConnectMultipleTags), service, tags, passingOnly, q)
+}
+
+// MockCatalog is a mock of catalog interface.
+type MockCatalog struct {
+	ctrl     *gomock.Controller
+	recorder *MockCatalogMockRecorder
+}
+
+// MockCatalogMockRecorder is the mock recorder for MockCatalog.
+type MockCatalogMockRecorder struct {
+	mock *MockCatalog
+}
+
+// NewMockCatalog creates a new mock instance.
+func NewMockCatalog(ctrl *gomock.Controller) *MockCatalog {
+	mock := &MockCatalog{ctrl: ctrl}
+	mock.recorder = &MockCatalogMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCatalog) EXPECT() *MockCatalogMockRecorder {
+	return m.recorder
+}
+
+// ServiceMultipleTags mocks base method.
+func (m *MockCatalog) ServiceMultipleTags(service string, tags []string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ServiceMultipleTags", service, tags, q)
+	ret0, _ := ret[0].([]*api.CatalogService)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ServiceMultipleTags indicates an expected call of ServiceMultipleTags.
+func (mr *MockCatalogMockRecorder) ServiceMultipleTags(service, tags, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ServiceMultipleTags", reflect.TypeOf((*MockCatalog)(nil).ServiceMultipleTags), service, tags, q)
+}
+
+// ConnectMultipleTags mocks base method.
+func (m *MockCatalog) ConnectMultipleTags(service string, tags []string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectMultipleTags", service, tags, q)
+	ret0, _ := ret[0].([]*api.CatalogService)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ConnectMultipleTags indicates an expected call of ConnectMultipleTags.
+func (mr *MockCatalogMockRecorder) ConnectMultipleTags(service, tags, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectMultipleTags", reflect.TypeOf((*MockCatalog)(nil).ConnectMultipleTags), service, tags, q)
+}
+
+// MockAgent is a mock of agent interface.
+type MockAgent struct {
+	ctrl     *gomock.Controller
+	recorder *MockAgentMockRecorder
+}
+
+// MockAgentMockRecorder is the mock recorder for MockAgent.
+type MockAgentMockRecorder struct {
+	mock *MockAgent
+}
+
+// NewMockAgent creates a new mock instance.
+func NewMockAgent(ctrl *gomock.Controller) *MockAgent {
+	mock := &MockAgent{ctrl: ctrl}
+	mock.recorder = &MockAgentMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAgent) EXPECT() *MockAgentMockRecorder {
+	return m.recorder
+}
+
+// NodeName mocks base method.
+func (m *MockAgent) NodeName() (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NodeName")
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NodeName indicates an expected call of NodeName.
+func (mr *MockAgentMockRecorder) NodeName() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NodeName", reflect.TypeOf((*MockAgent)(nil).NodeName))
+}
+
+// ConnectCARoots mocks base method.
+func (m *MockAgent) ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectCARoots", q)
+	ret0, _ := ret[0].(*api.CARootList)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ConnectCARoots indicates an expected call of ConnectCARoots.
+func (mr *MockAgentMockRecorder) ConnectCARoots(q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectCARoots", reflect.TypeOf((*MockAgent)(nil).ConnectCARoots), q)
+}
+
+// ConnectCALeaf mocks base method.
+func (m *MockAgent) ConnectCALeaf(serviceID string, q *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectCALeaf", serviceID, q)
+	ret0, _ := ret[0].(*api.LeafCert)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ConnectCALeaf indicates an expected call of ConnectCALeaf.
+func (mr *MockAgentMockRecorder) ConnectCALeaf(serviceID, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectCALeaf", reflect.TypeOf((*MockAgent)(nil).ConnectCALeaf), serviceID, q)
+}
+
+// ConnectAuthorize mocks base method.
+func (m *MockAgent) ConnectAuthorize(auth *api.AgentAuthorizeParams) (*api.AgentAuthorize, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConnectAuthorize", auth)
+	ret0, _ := ret[0].(*api.AgentAuthorize)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConnectAuthorize indicates an expected call of ConnectAuthorize.
+func (mr *MockAgentMockRecorder) ConnectAuthorize(auth interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConnectAuthorize", reflect.TypeOf((*MockAgent)(nil).ConnectAuthorize), auth)
+}
+
+// Services mocks base method.
+func (m *MockAgent) Services() (map[string]*api.AgentService, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Services")
+	ret0, _ := ret[0].(map[string]*api.AgentService)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Services indicates an expected call of Services.
+func (mr *MockAgentMockRecorder) Services() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Services", reflect.TypeOf((*MockAgent)(nil).Services))
+}
+
+// ServiceRegister mocks base method.
+func (m *MockAgent) ServiceRegister(service *api.AgentServiceRegistration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ServiceRegister", service)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ServiceRegister indicates an expected call of ServiceRegister.
+func (mr *MockAgentMockRecorder) ServiceRegister(service interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ServiceRegister", reflect.TypeOf((*MockAgent)(nil).ServiceRegister), service)
+}
+
+// ServiceDeregister mocks base method.
+func (m *MockAgent) ServiceDeregister(serviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ServiceDeregister", serviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ServiceDeregister indicates an expected call of ServiceDeregister.
+func (mr *MockAgentMockRecorder) ServiceDeregister(serviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ServiceDeregister", reflect.TypeOf((*MockAgent)(nil).ServiceDeregister), serviceID)
+}
+
+// UpdateTTL mocks base method.
+func (m *MockAgent) UpdateTTL(checkID, output, status string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateTTL", checkID, output, status)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateTTL indicates an expected call of UpdateTTL.
+func (mr *MockAgentMockRecorder) UpdateTTL(checkID, output, status interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateTTL", reflect.TypeOf((*MockAgent)(nil).UpdateTTL), checkID, output, status)
+}
+
+// MockCoordinates is a mock of coordinates interface.
+type MockCoordinates struct {
+	ctrl     *gomock.Controller
+	recorder *MockCoordinatesMockRecorder
+}
+
+// MockCoordinatesMockRecorder is the mock recorder for MockCoordinates.
+type MockCoordinatesMockRecorder struct {
+	mock *MockCoordinates
+}
+
+// NewMockCoordinates creates a new mock instance.
+func NewMockCoordinates(ctrl *gomock.Controller) *MockCoordinates {
+	mock := &MockCoordinates{ctrl: ctrl}
+	mock.recorder = &MockCoordinatesMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCoordinates) EXPECT() *MockCoordinatesMockRecorder {
+	return m.recorder
+}
+
+// Node mocks base method.
+func (m *MockCoordinates) Node(node string, q *api.QueryOptions) ([]*api.CoordinateEntry, *api.QueryMeta, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Node", node, q)
+	ret0, _ := ret[0].([]*api.CoordinateEntry)
+	ret1, _ := ret[1].(*api.QueryMeta)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Node indicates an expected call of Node.
+func (mr *MockCoordinatesMockRecorder) Node(node, q interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Node", reflect.TypeOf((*MockCoordinates)(nil).Node), node, q)
+}
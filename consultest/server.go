@@ -0,0 +1,602 @@
+// Package consultest provides an in-memory fake of the Consul HTTP API for tests.
+//
+// The fake implements the subset of the API used by the resolver and the registrar:
+// health and catalog service queries with blocking-query semantics (X-Consul-Index,
+// index and wait parameters), agent self, services, registration and TTL checks.
+// Every change of the state increments the single raft-like index.
+package consultest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultNode is the name of the agent node of the fake.
+	DefaultNode = "node-1"
+	// DefaultDatacenter is the datacenter of the fake.
+	DefaultDatacenter = "dc1"
+
+	serfHealth  = "serfHealth"
+	defaultWait = 5 * time.Minute
+)
+
+type node struct {
+	node   *api.Node
+	checks api.HealthChecks
+}
+
+type instance struct {
+	node    string
+	service *api.AgentService
+	checks  api.HealthChecks
+}
+
+// instanceKey identifies the instance, service IDs are unique only within the node.
+type instanceKey struct {
+	node      string
+	serviceID string
+}
+
+// Server is the fake Consul agent. Use Addr in the DSN of the resolver.
+type Server struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	index     uint64
+	changed   chan struct{}
+	nodes     map[string]*node
+	instances map[instanceKey]*instance
+}
+
+// NewServer starts the fake. It should be closed after the test.
+func NewServer() *Server {
+	s := &Server{
+		index:     1,
+		changed:   make(chan struct{}),
+		nodes:     make(map[string]*node),
+		instances: make(map[instanceKey]*instance),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/self", s.agentSelf)
+	mux.HandleFunc("/v1/agent/services", s.agentServices)
+	mux.HandleFunc("/v1/agent/service/register", s.agentRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.agentDeregister)
+	mux.HandleFunc("/v1/agent/check/update/", s.agentUpdateTTL)
+	mux.HandleFunc("/v1/health/service/", s.healthService)
+	mux.HandleFunc("/v1/health/connect/", s.healthConnect)
+	mux.HandleFunc("/v1/catalog/service/", s.catalogService)
+	mux.HandleFunc("/v1/catalog/connect/", s.catalogConnect)
+	mux.HandleFunc("/v1/coordinate/nodes", s.coordinateNodes)
+	mux.HandleFunc("/v1/coordinate/node/", s.coordinateNode)
+
+	s.srv = httptest.NewServer(mux)
+
+	return s
+}
+
+// Addr returns the address of the fake in the host:port form.
+func (s *Server) Addr() string {
+	return s.srv.Listener.Addr().String()
+}
+
+// Config returns configuration of the Consul client connected to the fake.
+func (s *Server) Config() *api.Config {
+	return &api.Config{Address: s.Addr()}
+}
+
+// Close shuts the fake down. Blocked queries are interrupted.
+func (s *Server) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+// Index returns the current index of the fake.
+func (s *Server) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.index
+}
+
+// ResetIndex moves the index backward, the same way as after
+// the restore of the snapshot. Blocked queries aren't woken up.
+func (s *Server) ResetIndex() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index = 1
+}
+
+// Register adds the service instance or replaces the one with the same node and service ID.
+// The agent node with passing serfHealth check is used if the entry has no node.
+// The service ID defaults to the service name, checks are bound to the instance.
+func (s *Server) Register(e *api.ServiceEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	svc := *e.Service
+	if svc.ID == "" {
+		svc.ID = svc.Service
+	}
+
+	n := &api.Node{Node: DefaultNode, Address: "127.0.0.1"}
+	if e.Node != nil {
+		n = e.Node
+	}
+
+	checks := make(api.HealthChecks, 0, len(e.Checks))
+	for _, c := range e.Checks {
+		check := *c
+		check.Node = n.Node
+		check.ServiceID = svc.ID
+		check.ServiceName = svc.Service
+
+		checks = append(checks, &check)
+	}
+
+	s.register(n, &svc, checks)
+}
+
+// Deregister removes the service instance from the node, e.g. DefaultNode.
+func (s *Server) Deregister(nodeName, serviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.instances, instanceKey{node: nodeName, serviceID: serviceID})
+	s.bump()
+}
+
+// SetCheck sets the status of the check of the instance on the node
+// adding the check if it doesn't exist.
+func (s *Server) SetCheck(nodeName, serviceID, checkID, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inst, ok := s.instances[instanceKey{node: nodeName, serviceID: serviceID}]
+	if !ok {
+		return
+	}
+
+	inst.checks = setCheck(inst.checks, &api.HealthCheck{
+		Node:        inst.node,
+		CheckID:     checkID,
+		Name:        checkID,
+		Status:      status,
+		ServiceID:   serviceID,
+		ServiceName: inst.service.Service,
+	})
+	s.bump()
+}
+
+// SetNodeCheck sets the status of the node check (e.g. serfHealth)
+// adding the check if it doesn't exist.
+func (s *Server) SetNodeCheck(nodeName, checkID, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.nodes[nodeName]
+	if !ok {
+		return
+	}
+
+	n.checks = setCheck(n.checks, &api.HealthCheck{
+		Node:    nodeName,
+		CheckID: checkID,
+		Name:    checkID,
+		Status:  status,
+	})
+	s.bump()
+}
+
+func (s *Server) register(n *api.Node, svc *api.AgentService, checks api.HealthChecks) {
+	stored, ok := s.nodes[n.Node]
+	if !ok {
+		nn := *n
+		if nn.Datacenter == "" {
+			nn.Datacenter = DefaultDatacenter
+		}
+
+		stored = &node{
+			node: &nn,
+			checks: api.HealthChecks{{
+				Node:    n.Node,
+				CheckID: serfHealth,
+				Name:    "Serf Health Status",
+				Status:  api.HealthPassing,
+			}},
+		}
+		s.nodes[n.Node] = stored
+	}
+
+	key := instanceKey{node: n.Node, serviceID: svc.ID}
+	if old, ok := s.instances[key]; ok {
+		svc.CreateIndex = old.service.CreateIndex
+	} else {
+		svc.CreateIndex = s.index + 1
+	}
+
+	svc.ModifyIndex = s.index + 1
+	svc.Datacenter = stored.node.Datacenter
+
+	s.instances[key] = &instance{node: n.Node, service: svc, checks: checks}
+	s.bump()
+}
+
+// bump increments the index and wakes up blocked queries. It's called under the lock.
+func (s *Server) bump() {
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func setCheck(checks api.HealthChecks, c *api.HealthCheck) api.HealthChecks {
+	for i, old := range checks {
+		if old.CheckID == c.CheckID {
+			updated := *old
+			updated.Status = c.Status
+			updated.Output = c.Output
+
+			checks[i] = &updated
+
+			return checks
+		}
+	}
+
+	return append(checks, c)
+}
+
+// block waits until the index is greater than the one from the request, the wait
+// time has passed or the request is cancelled. It's called and returns under the lock.
+func (s *Server) block(r *http.Request) {
+	q := r.URL.Query()
+
+	index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+	if index == 0 {
+		return
+	}
+
+	wait := defaultWait
+	if d, err := time.ParseDuration(q.Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for s.index <= index {
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-timeout.C:
+			s.mu.Lock()
+			return
+		case <-r.Context().Done():
+			s.mu.Lock()
+			return
+		}
+	}
+}
+
+// entries returns the entries of the instances matching passed function
+// and the tags from the request sorted by node and service ID.
+func (s *Server) entries(r *http.Request, match func(*api.AgentService) bool) []*api.ServiceEntry {
+	tags := r.URL.Query()["tag"]
+
+	entries := make([]*api.ServiceEntry, 0)
+	for _, inst := range s.instances {
+		if !match(inst.service) || !hasTags(inst.service.Tags, tags) {
+			continue
+		}
+
+		n := s.nodes[inst.node]
+
+		checks := make(api.HealthChecks, 0, len(n.checks)+len(inst.checks))
+		checks = append(checks, n.checks...)
+		checks = append(checks, inst.checks...)
+
+		svc := *inst.service
+		entries = append(entries, &api.ServiceEntry{Node: n.node, Service: &svc, Checks: checks})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Node.Node != entries[j].Node.Node {
+			return entries[i].Node.Node < entries[j].Node.Node
+		}
+
+		return entries[i].Service.ID < entries[j].Service.ID
+	})
+
+	return entries
+}
+
+// matchService matches typical instances of the named service.
+func matchService(name string) func(*api.AgentService) bool {
+	return func(svc *api.AgentService) bool {
+		return svc.Service == name && svc.Kind == api.ServiceKindTypical
+	}
+}
+
+// matchConnect matches sidecar proxies and Connect-native instances of the named service.
+func matchConnect(name string) func(*api.AgentService) bool {
+	return func(svc *api.AgentService) bool {
+		if svc.Kind == api.ServiceKindConnectProxy {
+			return svc.Proxy != nil && svc.Proxy.DestinationServiceName == name
+		}
+
+		return svc.Service == name && svc.Connect != nil && svc.Connect.Native
+	}
+}
+
+func (s *Server) healthService(w http.ResponseWriter, r *http.Request) {
+	s.health(w, r, matchService(strings.TrimPrefix(r.URL.Path, "/v1/health/service/")))
+}
+
+func (s *Server) healthConnect(w http.ResponseWriter, r *http.Request) {
+	s.health(w, r, matchConnect(strings.TrimPrefix(r.URL.Path, "/v1/health/connect/")))
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request, match func(*api.AgentService) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block(r)
+
+	entries := s.entries(r, match)
+	if _, passing := r.URL.Query()["passing"]; passing {
+		selected := entries[:0]
+		for _, e := range entries {
+			if e.Checks.AggregatedStatus() == api.HealthPassing {
+				selected = append(selected, e)
+			}
+		}
+
+		entries = selected
+	}
+
+	s.reply(w, entries)
+}
+
+func (s *Server) catalogService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/catalog/service/")
+	s.catalog(w, r, func(svc *api.AgentService) bool {
+		return svc.Service == name
+	})
+}
+
+func (s *Server) catalogConnect(w http.ResponseWriter, r *http.Request) {
+	s.catalog(w, r, matchConnect(strings.TrimPrefix(r.URL.Path, "/v1/catalog/connect/")))
+}
+
+// catalog replies with the matched instances in the catalog form, i.e. without checks.
+func (s *Server) catalog(w http.ResponseWriter, r *http.Request, match func(*api.AgentService) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block(r)
+
+	entries := s.entries(r, match)
+
+	services := make([]*api.CatalogService, 0, len(entries))
+	for _, e := range entries {
+		services = append(services, &api.CatalogService{
+			ID:             e.Node.ID,
+			Node:           e.Node.Node,
+			Address:        e.Node.Address,
+			Datacenter:     e.Node.Datacenter,
+			NodeMeta:       e.Node.Meta,
+			ServiceID:      e.Service.ID,
+			ServiceName:    e.Service.Service,
+			ServiceAddress: e.Service.Address,
+			ServiceTags:    e.Service.Tags,
+			ServiceMeta:    e.Service.Meta,
+			ServicePort:    e.Service.Port,
+			ServiceWeights: api.Weights{Passing: e.Service.Weights.Passing, Warning: e.Service.Weights.Warning},
+			ServiceProxy:   e.Service.Proxy,
+			Namespace:      e.Service.Namespace,
+			Partition:      e.Service.Partition,
+			CreateIndex:    e.Service.CreateIndex,
+			ModifyIndex:    e.Service.ModifyIndex,
+		})
+	}
+
+	s.reply(w, services)
+}
+
+func (s *Server) coordinateNodes(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reply(w, []*api.CoordinateEntry{})
+}
+
+// coordinateNode replies as Consul does for the nodes without coordinates.
+func (s *Server) coordinateNode(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) agentSelf(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reply(w, map[string]map[string]interface{}{
+		"Config": {
+			"NodeName":   DefaultNode,
+			"Datacenter": DefaultDatacenter,
+		},
+	})
+}
+
+func (s *Server) agentServices(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	services := make(map[string]*api.AgentService)
+	for key, inst := range s.instances {
+		if key.node == DefaultNode {
+			services[key.serviceID] = inst.service
+		}
+	}
+
+	s.reply(w, services)
+}
+
+func (s *Server) agentRegister(w http.ResponseWriter, r *http.Request) {
+	var reg api.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	svc := &api.AgentService{
+		Kind:    reg.Kind,
+		ID:      reg.ID,
+		Service: reg.Name,
+		Tags:    reg.Tags,
+		Meta:    reg.Meta,
+		Port:    reg.Port,
+		Address: reg.Address,
+		Proxy:   reg.Proxy,
+		Connect: reg.Connect,
+		Weights: api.AgentWeights{Passing: 1, Warning: 1},
+	}
+
+	if svc.ID == "" {
+		svc.ID = svc.Service
+	}
+
+	if reg.Weights != nil {
+		svc.Weights = *reg.Weights
+	}
+
+	defs := reg.Checks
+	if reg.Check != nil {
+		defs = append(api.AgentServiceChecks{reg.Check}, defs...)
+	}
+
+	checks := make(api.HealthChecks, 0, len(defs))
+	for i, def := range defs {
+		id := def.CheckID
+		switch {
+		case id != "":
+		case len(defs) == 1:
+			id = "service:" + svc.ID
+		default:
+			id = fmt.Sprintf("service:%s:%d", svc.ID, i+1)
+		}
+
+		status := def.Status
+		if status == "" {
+			status = api.HealthCritical
+		}
+
+		checks = append(checks, &api.HealthCheck{
+			Node:        DefaultNode,
+			CheckID:     id,
+			Name:        def.Name,
+			Status:      status,
+			ServiceID:   svc.ID,
+			ServiceName: svc.Service,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.register(&api.Node{Node: DefaultNode, Address: "127.0.0.1"}, svc, checks)
+}
+
+func (s *Server) agentDeregister(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := instanceKey{node: DefaultNode, serviceID: id}
+	if _, ok := s.instances[key]; !ok {
+		http.Error(w, fmt.Sprintf("Unknown service ID %q", id), http.StatusNotFound)
+		return
+	}
+
+	delete(s.instances, key)
+	s.bump()
+}
+
+func (s *Server) agentUpdateTTL(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+
+	var update struct {
+		Status string
+		Output string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, inst := range s.instances {
+		if inst.node != DefaultNode {
+			continue
+		}
+
+		for _, c := range inst.checks {
+			if c.CheckID != id {
+				continue
+			}
+
+			if c.Status != update.Status || c.Output != update.Output {
+				inst.checks = setCheck(inst.checks, &api.HealthCheck{CheckID: id, Status: update.Status, Output: update.Output})
+				s.bump()
+			}
+
+			return
+		}
+	}
+
+	http.Error(w, fmt.Sprintf("CheckID %q does not have associated TTL", id), http.StatusNotFound)
+}
+
+// reply writes the JSON body with the current index. It's called under the lock.
+func (s *Server) reply(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	w.Header().Set("X-Consul-Knownleader", "true")
+	w.Header().Set("X-Consul-Lastcontact", "0")
+
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func hasTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,244 @@
+package consultest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func newClient(t *testing.T) (*Server, *api.Client) {
+	t.Helper()
+
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	client, err := api.NewClient(s.Config())
+	require.NoError(t, err)
+
+	return s, client
+}
+
+func TestServer_HealthService(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+
+	s.Register(&api.ServiceEntry{
+		Service: &api.AgentService{ID: "svc-1", Service: "svc", Address: "127.0.0.1", Port: 1, Tags: []string{"green"}},
+	})
+	s.Register(&api.ServiceEntry{
+		Node:    &api.Node{Node: "node-2", Address: "127.0.0.2"},
+		Service: &api.AgentService{ID: "svc-2", Service: "svc", Address: "127.0.0.2", Port: 1},
+		Checks:  api.HealthChecks{{CheckID: "grpc", Status: api.HealthCritical}},
+	})
+	s.Register(&api.ServiceEntry{
+		Service: &api.AgentService{Service: "other", Address: "127.0.0.3", Port: 1},
+	})
+
+	entries, meta, err := client.Health().Service("svc", "", false, nil)
+	require.NoError(t, err)
+	require.Equal(t, s.Index(), meta.LastIndex)
+	require.Len(t, entries, 2)
+	require.Equal(t, "svc-1", entries[0].Service.ID)
+	require.Equal(t, DefaultDatacenter, entries[0].Node.Datacenter)
+	require.Equal(t, "serfHealth", entries[0].Checks[0].CheckID)
+
+	entries, _, err = client.Health().Service("svc", "green", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "svc-1", entries[0].Service.ID)
+
+	entries, _, err = client.Health().Service("svc", "", true, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "svc-1", entries[0].Service.ID)
+
+	s.SetCheck("node-2", "svc-2", "grpc", api.HealthPassing)
+	s.SetNodeCheck(DefaultNode, "serfHealth", api.HealthCritical)
+
+	entries, _, err = client.Health().Service("svc", "", true, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "svc-2", entries[0].Service.ID)
+
+	s.Deregister("node-2", "svc-2")
+
+	entries, _, err = client.Health().Service("svc", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestServer_SameServiceIDOnNodes(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+
+	// service IDs are unique only within the node, e.g. 'web' registered by every agent
+	s.Register(&api.ServiceEntry{
+		Service: &api.AgentService{ID: "web", Service: "web", Address: "127.0.0.1", Port: 1},
+	})
+	s.Register(&api.ServiceEntry{
+		Node:    &api.Node{Node: "node-2", Address: "127.0.0.2"},
+		Service: &api.AgentService{ID: "web", Service: "web", Address: "127.0.0.2", Port: 1},
+		Checks:  api.HealthChecks{{CheckID: "grpc", Status: api.HealthPassing}},
+	})
+
+	entries, _, err := client.Health().Service("web", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, DefaultNode, entries[0].Node.Node)
+	require.Equal(t, "node-2", entries[1].Node.Node)
+
+	s.SetCheck("node-2", "web", "grpc", api.HealthCritical)
+
+	entries, _, err = client.Health().Service("web", "", true, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, DefaultNode, entries[0].Node.Node)
+
+	// the agent sees only the instance of its own node
+	services, err := client.Agent().Services()
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	require.Equal(t, "127.0.0.1", services["web"].Address)
+
+	s.Deregister(DefaultNode, "web")
+
+	entries, _, err = client.Health().Service("web", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "node-2", entries[0].Node.Node)
+}
+
+func TestServer_BlockingQuery(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+	s.Register(&api.ServiceEntry{Service: &api.AgentService{Service: "svc", Address: "127.0.0.1", Port: 1}})
+
+	_, meta, err := client.Health().Service("svc", "", false, nil)
+	require.NoError(t, err)
+
+	// wait time passes without changes
+	start := time.Now()
+	_, again, err := client.Health().Service("svc", "", false, &api.QueryOptions{
+		WaitIndex: meta.LastIndex,
+		WaitTime:  50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Equal(t, meta.LastIndex, again.LastIndex)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// the change unblocks the query
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Register(&api.ServiceEntry{Service: &api.AgentService{ID: "svc-2", Service: "svc", Address: "127.0.0.2", Port: 1}})
+	}()
+
+	entries, changed, err := client.Health().Service("svc", "", false, &api.QueryOptions{
+		WaitIndex: meta.LastIndex,
+		WaitTime:  time.Minute,
+	})
+	require.NoError(t, err)
+	require.Greater(t, changed.LastIndex, meta.LastIndex)
+	require.Len(t, entries, 2)
+
+	// the index goes backward after reset
+	s.ResetIndex()
+
+	_, reset, err := client.Health().Service("svc", "", false, &api.QueryOptions{
+		WaitIndex: changed.LastIndex,
+		WaitTime:  10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Less(t, reset.LastIndex, changed.LastIndex)
+}
+
+func TestServer_Connect(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+	s.Register(&api.ServiceEntry{Service: &api.AgentService{Service: "payments", Address: "127.0.0.1", Port: 1}})
+	s.Register(&api.ServiceEntry{Service: &api.AgentService{
+		Kind:    api.ServiceKindConnectProxy,
+		Service: "payments-sidecar-proxy",
+		Port:    21000,
+		Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "payments"},
+	}})
+
+	entries, _, err := client.Health().Connect("payments", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "payments-sidecar-proxy", entries[0].Service.ID)
+
+	entries, _, err = client.Health().Service("payments", "", false, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "payments", entries[0].Service.ID)
+}
+
+func TestServer_Catalog(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+	s.Register(&api.ServiceEntry{
+		Service: &api.AgentService{Service: "svc", Address: "127.0.0.1", Port: 1, Tags: []string{"green"}},
+		Checks:  api.HealthChecks{{CheckID: "grpc", Status: api.HealthCritical}},
+	})
+
+	services, _, err := client.Catalog().Service("svc", "green", nil)
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	require.Equal(t, "127.0.0.1", services[0].ServiceAddress)
+	require.Equal(t, DefaultNode, services[0].Node)
+
+	s.Register(&api.ServiceEntry{Service: &api.AgentService{
+		Kind:    api.ServiceKindConnectProxy,
+		Service: "svc-sidecar-proxy",
+		Port:    21000,
+		Proxy:   &api.AgentServiceConnectProxyConfig{DestinationServiceName: "svc"},
+	}})
+
+	services, _, err = client.Catalog().Connect("svc", "", nil)
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	require.Equal(t, "svc-sidecar-proxy", services[0].ServiceID)
+}
+
+func TestServer_Agent(t *testing.T) {
+	t.Parallel()
+
+	s, client := newClient(t)
+
+	name, err := client.Agent().NodeName()
+	require.NoError(t, err)
+	require.Equal(t, DefaultNode, name)
+
+	require.NoError(t, client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:    "payments-1",
+		Name:  "payments",
+		Port:  50051,
+		Check: &api.AgentServiceCheck{CheckID: "ttl", TTL: "10s"},
+	}))
+
+	services, err := client.Agent().Services()
+	require.NoError(t, err)
+	require.Contains(t, services, "payments-1")
+
+	entries, _, err := client.Health().Service("payments", "", true, nil)
+	require.NoError(t, err)
+	require.Empty(t, entries, "TTL check is critical until updated")
+
+	require.NoError(t, client.Agent().UpdateTTL("ttl", "ok", api.HealthPassing))
+
+	entries, _, err = client.Health().Service("payments", "", true, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.Error(t, client.Agent().UpdateTTL("unknown", "ok", api.HealthPassing))
+
+	require.NoError(t, client.Agent().ServiceDeregister("payments-1"))
+	require.Equal(t, 0, len(s.instances))
+}
@@ -0,0 +1,285 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/credentials"
+)
+
+// ErrNoConnectCerts is returned by the handshake if the Connect
+// certificates aren't fetched from the agent yet.
+var ErrNoConnectCerts = errors.New("connect certificates are not loaded")
+
+// ErrNoServerIdentity is returned by the client handshake if the address
+// has no server identity, i.e. it isn't resolved with connect=true.
+var ErrNoServerIdentity = errors.New("server identity is unknown")
+
+// connectCerts holds the current Connect leaf certificate and roots.
+// They are replaced by the watchers, so the handshakes which follow
+// the rotation use the new ones without restarting the channels.
+type connectCerts struct {
+	mu    sync.RWMutex
+	leaf  *tls.Certificate
+	roots *x509.CertPool
+	ready chan struct{}
+}
+
+func (c *connectCerts) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.leaf, c.roots
+}
+
+func (c *connectCerts) set(leaf *tls.Certificate, roots *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasReady := c.leaf != nil && c.roots != nil
+	if leaf != nil {
+		c.leaf = leaf
+	}
+
+	if roots != nil {
+		c.roots = roots
+	}
+
+	if !wasReady && c.leaf != nil && c.roots != nil {
+		close(c.ready)
+	}
+}
+
+// wait blocks until both the leaf certificate and the roots are known.
+func (c *connectCerts) wait(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrNoConnectCerts, ctx.Err())
+	}
+}
+
+// verify checks the peer chain against the current roots and, if expected
+// isn't empty, that the peer leaf certificate has expected URI SAN.
+func (c *connectCerts) verify(rawCerts [][]byte, expected string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificates")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, roots := c.current()
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify peer certificate: %w", err)
+	}
+
+	if expected == "" {
+		return nil
+	}
+
+	for _, uri := range certs[0].URIs {
+		if uri.String() == expected {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("peer certificate doesn't have expected identity '%s'", expected)
+}
+
+// ConnectCredentials is credentials.TransportCredentials backed by
+// the Consul Connect leaf certificate of the service and the Connect CA roots.
+type ConnectCredentials struct {
+	certs *connectCerts
+	// skipIdentity allows the addresses without the server identity.
+	skipIdentity bool
+}
+
+// NewConnectCredentials returns gRPC transport credentials which use the Consul
+// Connect leaf certificate of the service from the DSN (e.g. 'consul://127.0.0.1:8500/web').
+// The leaf certificate and CA roots are watched with blocking queries until passed
+// context is cancelled, so rotated certificates are used by the following handshakes.
+// Client handshakes verify the server identity attached by the resolver with connect=true
+// and fail with ErrNoServerIdentity for the addresses without it.
+func NewConnectCredentials(ctx context.Context, dsn string, opts ...AgentOption) (*ConnectCredentials, error) {
+	c, err := newAgentClient(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := &connectCerts{ready: make(chan struct{})}
+	go c.watchLeaf(ctx, certs)
+	go c.watchRoots(ctx, certs)
+
+	return &ConnectCredentials{certs: certs}, nil
+}
+
+// WithoutIdentityVerification returns the copy of the credentials which only
+// verify the server chain against Connect roots if the address has no server
+// identity, e.g. it's resolved by other resolver than this one with connect=true.
+func (c *ConnectCredentials) WithoutIdentityVerification() *ConnectCredentials {
+	return &ConnectCredentials{certs: c.certs, skipIdentity: true}
+}
+
+func (c *ConnectCredentials) ClientHandshake(
+	ctx context.Context,
+	authority string,
+	rawConn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	if err := c.certs.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	var expected string
+	if info := credentials.ClientHandshakeInfoFromContext(ctx); info.Attributes != nil {
+		expected, _ = info.Attributes.Value(identityKey{}).(string)
+	}
+
+	if expected == "" && !c.skipIdentity {
+		return nil, nil, fmt.Errorf("%w: address of '%s' isn't resolved with connect=true", ErrNoServerIdentity, authority)
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName: hostname(authority),
+		NextProtos: []string{"h2"},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			leaf, _ := c.certs.current()
+			return leaf, nil
+		},
+		// the chain is verified against Connect roots by VerifyPeerCertificate,
+		// Connect certificates don't have DNS SANs to match the server name
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return c.certs.verify(rawCerts, expected)
+		},
+	})
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, tlsInfo(conn), nil
+}
+
+func (c *ConnectCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	// the client retries with backoff, so there is no point to wait here
+	if leaf, roots := c.certs.current(); leaf == nil || roots == nil {
+		return nil, nil, ErrNoConnectCerts
+	}
+
+	conn := tls.Server(rawConn, &tls.Config{
+		NextProtos: []string{"h2"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			leaf, _ := c.certs.current()
+			return leaf, nil
+		},
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return c.certs.verify(rawCerts, "")
+		},
+	})
+
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, tlsInfo(conn), nil
+}
+
+func (c *ConnectCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: "tls",
+		SecurityVersion:  "1.2",
+	}
+}
+
+func (c *ConnectCredentials) Clone() credentials.TransportCredentials {
+	return &ConnectCredentials{certs: c.certs, skipIdentity: c.skipIdentity}
+}
+
+// OverrideServerName does nothing, the server is verified by its identity.
+func (c *ConnectCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+func tlsInfo(conn *tls.Conn) credentials.TLSInfo {
+	return credentials.TLSInfo{
+		State:          conn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+	}
+}
+
+func hostname(authority string) string {
+	host, _, err := net.SplitHostPort(authority)
+	if err != nil {
+		return authority
+	}
+
+	return host
+}
+
+// watchLeaf keeps the leaf certificate of the service up to date until passed context is cancelled.
+func (c *agentClient) watchLeaf(ctx context.Context, certs *connectCerts) {
+	c.watch(ctx, "Connect leaf certificate", func(q *api.QueryOptions) (*api.QueryMeta, error) {
+		leaf, meta, err := c.agent.ConnectCALeaf(c.service, q)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse leaf certificate: %w", err)
+		}
+
+		certs.set(&cert, nil)
+
+		return meta, nil
+	})
+}
+
+// watchRoots keeps the Connect CA roots up to date until passed context is cancelled.
+func (c *agentClient) watchRoots(ctx context.Context, certs *connectCerts) {
+	c.watch(ctx, "Connect CA roots", func(q *api.QueryOptions) (*api.QueryMeta, error) {
+		list, meta, err := c.agent.ConnectCARoots(q)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		for _, root := range list.Roots {
+			if !roots.AppendCertsFromPEM([]byte(root.RootCertPEM)) {
+				return nil, fmt.Errorf("failed to parse root certificate '%s'", root.ID)
+			}
+		}
+
+		certs.set(nil, roots)
+
+		return meta, nil
+	})
+}
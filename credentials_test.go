@@ -0,0 +1,382 @@
+package consul
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// testCA issues Connect-like certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Consul CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// leaf issues the leaf certificate with the passed SPIFFE ID.
+func (ca *testCA) leaf(t *testing.T, id string) *api.LeafCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	uri, err := url.Parse(id)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &api.LeafCert{
+		CertPEM:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		ServiceURI:    id,
+	}
+}
+
+func rawCert(t *testing.T, leaf *api.LeafCert) [][]byte {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	require.NoError(t, err)
+
+	return cert.Certificate
+}
+
+func TestConnectCerts_Verify(t *testing.T) {
+	t.Parallel()
+
+	const payments = "spiffe://td.consul/ns/default/dc/dc1/svc/payments"
+
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	certs := &connectCerts{ready: make(chan struct{})}
+	certs.set(nil, roots)
+
+	tt := []struct {
+		name        string
+		peer        [][]byte
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "expected identity",
+			peer:     rawCert(t, ca.leaf(t, payments)),
+			expected: payments,
+		},
+		{
+			name: "identity is unknown",
+			peer: rawCert(t, ca.leaf(t, payments)),
+		},
+		{
+			name:        "unexpected identity",
+			peer:        rawCert(t, ca.leaf(t, "spiffe://td.consul/ns/default/dc/dc1/svc/web")),
+			expected:    payments,
+			expectError: true,
+		},
+		{
+			name:        "untrusted CA",
+			peer:        rawCert(t, newTestCA(t).leaf(t, payments)),
+			expected:    payments,
+			expectError: true,
+		},
+		{
+			name:        "no certificates",
+			expectError: true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := certs.verify(tc.peer, tc.expected)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+// newTestConnectCredentials returns credentials of the service with the passed leaf certificate.
+func newTestConnectCredentials(t *testing.T, ca *testCA, service string, leaf *api.LeafCert) *ConnectCredentials {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	block := func(*api.QueryOptions) {
+		<-ctx.Done()
+	}
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().ConnectCALeaf(service, gomock.Any()).Return(leaf, &api.QueryMeta{LastIndex: 1}, nil),
+		mockAgent.EXPECT().ConnectCALeaf(service, gomock.Any()).Do(func(_ string, q *api.QueryOptions) {
+			block(q)
+		}).Return(nil, nil, context.Canceled).MaxTimes(1),
+	)
+	gomock.InOrder(
+		mockAgent.EXPECT().ConnectCARoots(gomock.Any()).Return(&api.CARootList{
+			TrustDomain: "td.consul",
+			Roots:       []*api.CARoot{{ID: "1", RootCertPEM: ca.pem}},
+		}, &api.QueryMeta{LastIndex: 1}, nil),
+		mockAgent.EXPECT().ConnectCARoots(gomock.Any()).Do(block).Return(nil, nil, context.Canceled).MaxTimes(1),
+	)
+
+	c := &agentClient{
+		logger:     noopLogger{},
+		onError:    func(error) {},
+		service:    service,
+		maxBackoff: time.Second,
+		agent:      mockAgent,
+	}
+
+	certs := &connectCerts{ready: make(chan struct{})}
+	go c.watchLeaf(ctx, certs)
+	go c.watchRoots(ctx, certs)
+	require.NoError(t, certs.wait(ctx))
+
+	return &ConnectCredentials{certs: certs}
+}
+
+func TestConnectCredentials(t *testing.T) {
+	ca := newTestCA(t)
+
+	const (
+		payments = "spiffe://td.consul/ns/default/dc/dc1/svc/payments"
+		web      = "spiffe://td.consul/ns/default/dc/dc1/svc/web"
+	)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer(grpc.Creds(newTestConnectCredentials(t, ca, "payments", ca.leaf(t, payments))))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(srv.Stop)
+
+	clientCreds := newTestConnectCredentials(t, ca, "web", ca.leaf(t, web))
+
+	tt := []struct {
+		name         string
+		identity     string
+		skipIdentity bool
+		expectError  bool
+	}{
+		{
+			name:     "expected identity",
+			identity: payments,
+		},
+		{
+			name:        "unexpected identity",
+			identity:    "spiffe://td.consul/ns/default/dc/dc1/svc/billing",
+			expectError: true,
+		},
+		{
+			name:        "no identity",
+			expectError: true,
+		},
+		{
+			name:         "no identity without verification",
+			skipIdentity: true,
+		},
+		{
+			name:         "unexpected identity without verification",
+			identity:     "spiffe://td.consul/ns/default/dc/dc1/svc/billing",
+			skipIdentity: true,
+			expectError:  true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			creds := clientCreds
+			if tc.skipIdentity {
+				creds = clientCreds.WithoutIdentityVerification()
+			}
+
+			err := checkConnectHealth(t, lis.Addr().String(), tc.identity, creds)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+// checkConnectHealth calls the health service at addr with the server identity attached as by the resolver.
+func checkConnectHealth(t *testing.T, addr, identity string, creds *ConnectCredentials) error {
+	t.Helper()
+
+	a := resolver.Address{Addr: addr}
+	if identity != "" {
+		a.Attributes = attributes.New(identityKey{}, identity)
+	}
+
+	rb := manual.NewBuilderWithScheme("test")
+	rb.InitialState(resolver.State{Addresses: []resolver.Address{a}})
+
+	conn, err := grpc.Dial("test:///payments", grpc.WithResolvers(rb), grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+
+	return err
+}
+
+func TestConnectCredentials_Rotation(t *testing.T) {
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+
+	const (
+		payments = "spiffe://td.consul/ns/default/dc/dc1/svc/payments"
+		web      = "spiffe://td.consul/ns/default/dc/dc1/svc/web"
+	)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// the server is already rotated to the new CA
+	srv := grpc.NewServer(grpc.Creds(newTestConnectCredentials(t, newCA, "payments", newCA.leaf(t, payments))))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(srv.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	rotate := make(chan struct{})
+	block := func(*api.QueryOptions) {
+		<-ctx.Done()
+	}
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().ConnectCALeaf("web", gomock.Any()).Return(oldCA.leaf(t, web), &api.QueryMeta{LastIndex: 1}, nil),
+		mockAgent.EXPECT().ConnectCALeaf("web", gomock.Any()).DoAndReturn(
+			func(string, *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error) {
+				<-rotate
+				return newCA.leaf(t, web), &api.QueryMeta{LastIndex: 2}, nil
+			},
+		),
+		mockAgent.EXPECT().ConnectCALeaf("web", gomock.Any()).Do(func(_ string, q *api.QueryOptions) {
+			block(q)
+		}).Return(nil, nil, context.Canceled).MaxTimes(1),
+	)
+	gomock.InOrder(
+		mockAgent.EXPECT().ConnectCARoots(gomock.Any()).Return(&api.CARootList{
+			TrustDomain: "td.consul",
+			Roots:       []*api.CARoot{{ID: "1", RootCertPEM: oldCA.pem}},
+		}, &api.QueryMeta{LastIndex: 1}, nil),
+		mockAgent.EXPECT().ConnectCARoots(gomock.Any()).DoAndReturn(
+			func(*api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+				<-rotate
+				return &api.CARootList{
+					TrustDomain: "td.consul",
+					Roots:       []*api.CARoot{{ID: "2", RootCertPEM: newCA.pem}},
+				}, &api.QueryMeta{LastIndex: 2}, nil
+			},
+		),
+		mockAgent.EXPECT().ConnectCARoots(gomock.Any()).Do(block).Return(nil, nil, context.Canceled).MaxTimes(1),
+	)
+
+	c := &agentClient{
+		logger:     noopLogger{},
+		onError:    func(error) {},
+		service:    "web",
+		maxBackoff: time.Second,
+		agent:      mockAgent,
+	}
+
+	certs := &connectCerts{ready: make(chan struct{})}
+	go c.watchLeaf(ctx, certs)
+	go c.watchRoots(ctx, certs)
+	require.NoError(t, certs.wait(ctx))
+
+	creds := &ConnectCredentials{certs: certs}
+
+	// neither the server trusts the old leaf nor the old roots trust the server
+	require.Error(t, checkConnectHealth(t, lis.Addr().String(), payments, creds))
+
+	close(rotate)
+
+	// the following handshakes use the new leaf and roots without recreating the credentials
+	require.Eventually(t, func() bool {
+		return checkConnectHealth(t, lis.Addr().String(), payments, creds) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,251 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// InstanceID identifies service instance across Consul updates.
+type InstanceID struct {
+	Node      string
+	ServiceID string
+}
+
+func (id InstanceID) String() string {
+	return id.Node + "/" + id.ServiceID
+}
+
+// instanceID returns ID of the passed entry. Service address
+// is used for the entries without service ID.
+func instanceID(e *api.ServiceEntry) InstanceID {
+	var id InstanceID
+	if e.Node != nil {
+		id.Node = e.Node.Node
+	}
+
+	if e.Service != nil {
+		id.ServiceID = e.Service.ID
+		if id.ServiceID == "" {
+			id.ServiceID = fmt.Sprintf("%s:%d", e.Service.Address, e.Service.Port)
+		}
+	}
+
+	return id
+}
+
+// DeltaKind is a kind of the instance change.
+type DeltaKind int
+
+// Possible kinds of the instance change.
+const (
+	Added DeltaKind = iota + 1
+	Removed
+	Updated
+)
+
+func (k DeltaKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Updated:
+		return "updated"
+	default:
+		return fmt.Sprintf("DeltaKind(%d)", int(k))
+	}
+}
+
+// Changes is a set of instance fields changed by the update.
+type Changes uint
+
+// Instance fields tracked by the diff.
+const (
+	ChangedAddress Changes = 1 << iota
+	ChangedPort
+	ChangedTags
+	ChangedMeta
+	ChangedChecks
+	ChangedWeights
+)
+
+var changeNames = []string{"address", "port", "tags", "meta", "checks", "weights"}
+
+// Has reports whether all the passed fields are changed.
+func (c Changes) Has(f Changes) bool {
+	return c&f == f
+}
+
+func (c Changes) String() string {
+	names := make([]string, 0, len(changeNames))
+	for i, name := range changeNames {
+		if c.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Delta describes a change of the single service instance.
+type Delta struct {
+	Kind DeltaKind
+	ID   InstanceID
+	// Old is nil for added instances.
+	Old *api.ServiceEntry
+	// New is nil for removed instances.
+	New *api.ServiceEntry
+	// Changes is set for updated instances only.
+	Changes Changes
+}
+
+// WatchDeltas will send changes of the service instances into the
+// returned channel until passed context is cancelled. The first
+// message reports all the instances as added. Updates which don't
+// change anything tracked by Changes are not sent.
+func (r *Resolver) WatchDeltas(ctx context.Context) <-chan []Delta {
+	out := make(chan []Delta, 1)
+	in := r.WatchServiceChanges(ctx)
+
+	go func() {
+		defer close(out)
+
+		var prev []*api.ServiceEntry
+		for entries := range in {
+			deltas := diff(prev, entries)
+			prev = entries
+
+			if len(deltas) == 0 {
+				continue
+			}
+
+			select {
+			case out <- deltas:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// diff returns the changes needed to turn prev into cur. Removed
+// instances go first in the prev order, the rest follow in the cur order.
+func diff(prev, cur []*api.ServiceEntry) []Delta {
+	prevByID := make(map[InstanceID]*api.ServiceEntry, len(prev))
+	for _, e := range prev {
+		prevByID[instanceID(e)] = e
+	}
+
+	curByID := make(map[InstanceID]*api.ServiceEntry, len(cur))
+	for _, e := range cur {
+		curByID[instanceID(e)] = e
+	}
+
+	var deltas []Delta
+	for _, e := range prev {
+		id := instanceID(e)
+		if _, ok := curByID[id]; !ok {
+			deltas = append(deltas, Delta{Kind: Removed, ID: id, Old: e})
+		}
+	}
+
+	for _, e := range cur {
+		id := instanceID(e)
+
+		old, ok := prevByID[id]
+		if !ok {
+			deltas = append(deltas, Delta{Kind: Added, ID: id, New: e})
+			continue
+		}
+
+		if changes := compare(old, e); changes != 0 {
+			deltas = append(deltas, Delta{Kind: Updated, ID: id, Old: old, New: e, Changes: changes})
+		}
+	}
+
+	return deltas
+}
+
+// compare returns the fields which differ in the passed entries of the same instance.
+func compare(a, b *api.ServiceEntry) Changes {
+	var c Changes
+
+	sa, sb := a.Service, b.Service
+	if sa == nil {
+		sa = &api.AgentService{}
+	}
+
+	if sb == nil {
+		sb = &api.AgentService{}
+	}
+
+	if sa.Address != sb.Address {
+		c |= ChangedAddress
+	}
+
+	if sa.Port != sb.Port {
+		c |= ChangedPort
+	}
+
+	if !equalStrings(sa.Tags, sb.Tags) {
+		c |= ChangedTags
+	}
+
+	if !equalMeta(sa.Meta, sb.Meta) {
+		c |= ChangedMeta
+	}
+
+	if sa.Weights != sb.Weights {
+		c |= ChangedWeights
+	}
+
+	if !reflect.DeepEqual(checkStatuses(a.Checks), checkStatuses(b.Checks)) {
+		c |= ChangedChecks
+	}
+
+	return c
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalMeta(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkStatuses returns statuses of the passed checks by check ID.
+func checkStatuses(checks api.HealthChecks) map[string]string {
+	statuses := make(map[string]string, len(checks))
+	for _, c := range checks {
+		statuses[c.CheckID] = c.Status
+	}
+
+	return statuses
+}
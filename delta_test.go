@@ -0,0 +1,234 @@
+package consul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	entry := func(node, id string, mod func(e *api.ServiceEntry)) *api.ServiceEntry {
+		e := &api.ServiceEntry{
+			Node: &api.Node{Node: node},
+			Service: &api.AgentService{
+				ID:      id,
+				Address: "127.0.0.1",
+				Port:    8080,
+				Tags:    []string{"green"},
+				Meta:    map[string]string{"version": "1"},
+				Weights: api.AgentWeights{Passing: 1, Warning: 1},
+			},
+			Checks: api.HealthChecks{
+				{CheckID: "serfHealth", Status: api.HealthPassing},
+			},
+		}
+
+		if mod != nil {
+			mod(e)
+		}
+
+		return e
+	}
+
+	tt := []struct {
+		name   string
+		prev   []*api.ServiceEntry
+		cur    []*api.ServiceEntry
+		expect []Delta
+	}{
+		{
+			name: "initial",
+			cur:  []*api.ServiceEntry{entry("n1", "s1", nil)},
+			expect: []Delta{
+				{Kind: Added, ID: InstanceID{Node: "n1", ServiceID: "s1"}, New: entry("n1", "s1", nil)},
+			},
+		},
+		{
+			name: "no changes",
+			prev: []*api.ServiceEntry{entry("n1", "s1", nil), entry("n2", "s1", nil)},
+			cur: []*api.ServiceEntry{entry("n2", "s1", func(e *api.ServiceEntry) {
+				e.Service.ModifyIndex = 100
+				e.Checks[0].Output = "ok"
+			}), entry("n1", "s1", nil)},
+		},
+		{
+			name: "added and removed",
+			prev: []*api.ServiceEntry{entry("n1", "s1", nil), entry("n1", "s2", nil)},
+			cur:  []*api.ServiceEntry{entry("n1", "s2", nil), entry("n2", "s1", nil)},
+			expect: []Delta{
+				{Kind: Removed, ID: InstanceID{Node: "n1", ServiceID: "s1"}, Old: entry("n1", "s1", nil)},
+				{Kind: Added, ID: InstanceID{Node: "n2", ServiceID: "s1"}, New: entry("n2", "s1", nil)},
+			},
+		},
+		{
+			name: "updated",
+			prev: []*api.ServiceEntry{entry("n1", "s1", nil), entry("n1", "s2", nil)},
+			cur: []*api.ServiceEntry{
+				entry("n1", "s1", func(e *api.ServiceEntry) {
+					e.Service.Port = 8081
+					e.Service.Tags = []string{"blue"}
+				}),
+				entry("n1", "s2", func(e *api.ServiceEntry) {
+					e.Service.Meta = map[string]string{"version": "2"}
+					e.Service.Weights.Passing = 10
+					e.Checks[0].Status = api.HealthCritical
+				}),
+			},
+			expect: []Delta{
+				{
+					Kind: Updated,
+					ID:   InstanceID{Node: "n1", ServiceID: "s1"},
+					Old:  entry("n1", "s1", nil),
+					New: entry("n1", "s1", func(e *api.ServiceEntry) {
+						e.Service.Port = 8081
+						e.Service.Tags = []string{"blue"}
+					}),
+					Changes: ChangedPort | ChangedTags,
+				},
+				{
+					Kind: Updated,
+					ID:   InstanceID{Node: "n1", ServiceID: "s2"},
+					Old:  entry("n1", "s2", nil),
+					New: entry("n1", "s2", func(e *api.ServiceEntry) {
+						e.Service.Meta = map[string]string{"version": "2"}
+						e.Service.Weights.Passing = 10
+						e.Checks[0].Status = api.HealthCritical
+					}),
+					Changes: ChangedMeta | ChangedWeights | ChangedChecks,
+				},
+			},
+		},
+		{
+			name: "check added",
+			prev: []*api.ServiceEntry{entry("n1", "s1", nil)},
+			cur: []*api.ServiceEntry{entry("n1", "s1", func(e *api.ServiceEntry) {
+				e.Checks = append(e.Checks, &api.HealthCheck{CheckID: "service:s1", Status: api.HealthPassing})
+			})},
+			expect: []Delta{
+				{
+					Kind: Updated,
+					ID:   InstanceID{Node: "n1", ServiceID: "s1"},
+					Old:  entry("n1", "s1", nil),
+					New: entry("n1", "s1", func(e *api.ServiceEntry) {
+						e.Checks = append(e.Checks, &api.HealthCheck{CheckID: "service:s1", Status: api.HealthPassing})
+					}),
+					Changes: ChangedChecks,
+				},
+			},
+		},
+		{
+			name: "no service id",
+			prev: []*api.ServiceEntry{entry("n1", "", nil)},
+			cur: []*api.ServiceEntry{entry("n1", "", func(e *api.ServiceEntry) {
+				e.Service.Address = "127.0.0.2"
+			})},
+			expect: []Delta{
+				{Kind: Removed, ID: InstanceID{Node: "n1", ServiceID: "127.0.0.1:8080"}, Old: entry("n1", "", nil)},
+				{
+					Kind: Added,
+					ID:   InstanceID{Node: "n1", ServiceID: "127.0.0.2:8080"},
+					New: entry("n1", "", func(e *api.ServiceEntry) {
+						e.Service.Address = "127.0.0.2"
+					}),
+				},
+			},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.expect, diff(tc.prev, tc.cur))
+		})
+	}
+}
+
+func TestChanges_String(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "port,checks", (ChangedPort | ChangedChecks).String())
+	require.Equal(t, "", Changes(0).String())
+}
+
+func TestResolver_WatchDeltas(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockConsul := NewMockConsul(ctrl)
+	gomock.InOrder(
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			Near: "_agent",
+		}).Return([]*api.ServiceEntry{
+			{Node: &api.Node{Node: "n1"}, Service: &api.AgentService{ID: "s1", Address: "127.0.0.1", Port: 1024}},
+		}, &api.QueryMeta{LastIndex: 1}, nil),
+		// index bump without tracked changes is skipped
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 1,
+			Near:      "_agent",
+		}).Return([]*api.ServiceEntry{
+			{Node: &api.Node{Node: "n1"}, Service: &api.AgentService{ID: "s1", Address: "127.0.0.1", Port: 1024, ModifyIndex: 2}},
+		}, &api.QueryMeta{LastIndex: 2}, nil),
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 2,
+			Near:      "_agent",
+		}).Return(nil, &api.QueryMeta{LastIndex: 3}, nil),
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 3,
+			Near:      "_agent",
+		}).DoAndReturn(func(
+			_ string,
+			_ []string,
+			_ bool,
+			opt *api.QueryOptions,
+		) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			select {}
+		}).MaxTimes(1),
+	)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Near:    "_agent",
+			Sort:    sortNone,
+		},
+		c: mockConsul,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	out := s.WatchDeltas(ctx)
+	for _, expect := range [][]Delta{
+		{
+			{
+				Kind: Added,
+				ID:   InstanceID{Node: "n1", ServiceID: "s1"},
+				New:  &api.ServiceEntry{Node: &api.Node{Node: "n1"}, Service: &api.AgentService{ID: "s1", Address: "127.0.0.1", Port: 1024}},
+			},
+		},
+		{
+			{
+				Kind: Removed,
+				ID:   InstanceID{Node: "n1", ServiceID: "s1"},
+				Old:  &api.ServiceEntry{Node: &api.Node{Node: "n1"}, Service: &api.AgentService{ID: "s1", Address: "127.0.0.1", Port: 1024, ModifyIndex: 2}},
+			},
+		},
+	} {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("deltas haven't been sent")
+		case got := <-out:
+			require.Equal(t, expect, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"google.golang.org/grpc/resolver"
+)
+
+// Endpoint is a service instance resolved from Consul.
+type Endpoint struct {
+	// Addr is the address of the instance in the host:port form.
+	Addr string
+	// Entry is the Consul entry the endpoint was built from.
+	Entry *api.ServiceEntry
+	// Draining is set for the instance which has disappeared from
+	// Consul, but is retained during the removal grace period.
+	Draining bool
+	// RTT is the round trip time to the instance estimated
+	// from network coordinates. It's known only for sort=rtt.
+	RTT      time.Duration
+	rttKnown bool
+	// Weight is the weight of the instance service
+	// if the target consists of several services.
+	Weight int
+	// Identity is the SPIFFE ID expected from
+	// the instance. It's set for connect=true only.
+	Identity string
+}
+
+func newEndpoint(e *api.ServiceEntry) Endpoint {
+	return Endpoint{
+		Addr:  fmt.Sprintf("%s:%d", e.Service.Address, e.Service.Port),
+		Entry: e,
+	}
+}
+
+func newEndpoints(entries []*api.ServiceEntry) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(entries))
+	for _, e := range entries {
+		endpoints = append(endpoints, newEndpoint(e))
+	}
+
+	return endpoints
+}
+
+// address converts endpoint into the gRPC address. Values which change
+// over the life of the instance are balancer attributes, so they don't
+// affect identity of the SubConn and their changes don't cause reconnects.
+func (e Endpoint) address() resolver.Address {
+	addr := resolver.Address{Addr: e.Addr}
+	if e.Draining {
+		addr.BalancerAttributes = addr.BalancerAttributes.WithValue(drainingKey{}, true)
+	}
+
+	if e.Weight > 0 {
+		addr.BalancerAttributes = addr.BalancerAttributes.WithValue(weightKey{}, e.Weight)
+		if e.Entry != nil && e.Entry.Service != nil {
+			addr.BalancerAttributes = addr.BalancerAttributes.WithValue(serviceKey{}, serviceName(e.Entry))
+		}
+	}
+
+	if e.Identity != "" {
+		addr.Attributes = addr.Attributes.WithValue(identityKey{}, e.Identity)
+	}
+
+	if e.rttKnown {
+		addr.BalancerAttributes = addr.BalancerAttributes.WithValue(rttKey{}, e.RTT)
+	}
+
+	return addr
+}
+
+type drainingKey struct{}
+
+// IsDraining reports whether the address belongs to the instance which
+// has disappeared from Consul, but is retained during the removal grace period.
+func IsDraining(addr resolver.Address) bool {
+	draining, _ := addr.BalancerAttributes.Value(drainingKey{}).(bool)
+	return draining
+}
+
+type weightKey struct{}
+
+// Weight returns the weight of the service the address belongs to.
+// It's known only if the target consists of several services.
+func Weight(addr resolver.Address) (int, bool) {
+	weight, ok := addr.BalancerAttributes.Value(weightKey{}).(int)
+	return weight, ok
+}
+
+// serviceKey holds the name of the service the weight belongs to.
+type serviceKey struct{}
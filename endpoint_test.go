@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestEndpoint_AddressIdentity(t *testing.T) {
+	t.Parallel()
+
+	base := Endpoint{Addr: "127.0.0.1:1"}
+
+	tt := []struct {
+		name    string
+		changed Endpoint
+	}{
+		{
+			name:    "draining",
+			changed: Endpoint{Addr: "127.0.0.1:1", Draining: true},
+		},
+		{
+			name:    "rtt",
+			changed: Endpoint{Addr: "127.0.0.1:1", RTT: time.Millisecond, rttKnown: true},
+		},
+		{
+			name:    "weight",
+			changed: Endpoint{Addr: "127.0.0.1:1", Weight: 3},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// balancers key SubConns on the address map, so the changed
+			// endpoint must hit the SubConn of the original one
+			subConns := resolver.NewAddressMap()
+			subConns.Set(base.address(), "subconn")
+
+			got, ok := subConns.Get(tc.changed.address())
+			require.True(t, ok)
+			require.Equal(t, "subconn", got)
+			require.False(t, base.address().Equal(tc.changed.address()), "the change must be published")
+		})
+	}
+}
@@ -3,16 +3,17 @@ module github.com/mbobakov/grpc-consul-resolver
 go 1.19
 
 require (
+	github.com/armon/go-metrics v0.3.10
 	github.com/cenkalti/backoff/v4 v4.1.3
 	github.com/go-playground/form v3.1.4+incompatible
 	github.com/golang/mock v1.6.0
 	github.com/hashicorp/consul/api v1.14.0
+	github.com/hashicorp/serf v0.9.7
 	github.com/stretchr/testify v1.7.0
 	google.golang.org/grpc v1.49.0
 )
 
 require (
-	github.com/armon/go-metrics v0.3.10 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
@@ -21,7 +22,6 @@ require (
 	github.com/hashicorp/go-immutable-radix v1.3.0 // indirect
 	github.com/hashicorp/go-rootcerts v1.0.2 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
-	github.com/hashicorp/serf v0.9.7 // indirect
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
@@ -0,0 +1,155 @@
+package consul
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// graceKeeper retains endpoints which have disappeared
+// from Consul for the grace period marking them as draining.
+type graceKeeper struct {
+	period time.Duration
+	// max is the max number of retained endpoints, 0 means no limit.
+	max int
+
+	current []Endpoint
+	gone    map[InstanceID]goneEndpoint
+}
+
+type goneEndpoint struct {
+	Endpoint
+	until time.Time
+}
+
+func newGraceKeeper(period time.Duration, max int) *graceKeeper {
+	return &graceKeeper{
+		period: period,
+		max:    max,
+		gone:   make(map[InstanceID]goneEndpoint),
+	}
+}
+
+// update replaces current endpoints and returns them
+// followed by the retained ones in the order of expiration.
+func (g *graceKeeper) update(endpoints []Endpoint, now time.Time) []Endpoint {
+	ids := make(map[InstanceID]struct{}, len(endpoints))
+	for _, e := range endpoints {
+		id := instanceID(e.Entry)
+		ids[id] = struct{}{}
+		delete(g.gone, id)
+	}
+
+	for _, e := range g.current {
+		id := instanceID(e.Entry)
+		if _, ok := ids[id]; !ok {
+			e.Draining = true
+			g.gone[id] = goneEndpoint{Endpoint: e, until: now.Add(g.period)}
+		}
+	}
+
+	g.current = endpoints
+
+	return g.endpoints(now)
+}
+
+// endpoints drops expired endpoints and returns
+// the current ones followed by the retained ones.
+func (g *graceKeeper) endpoints(now time.Time) []Endpoint {
+	addrs := make(map[string]struct{}, len(g.current))
+	for _, e := range g.current {
+		addrs[e.Addr] = struct{}{}
+	}
+
+	gone := make([]goneEndpoint, 0, len(g.gone))
+	for id, e := range g.gone {
+		if !e.until.After(now) {
+			delete(g.gone, id)
+			continue
+		}
+
+		// the address may be taken by a new instance
+		if _, ok := addrs[e.Addr]; ok {
+			continue
+		}
+
+		gone = append(gone, e)
+	}
+
+	sort.Slice(gone, func(i, j int) bool {
+		if !gone[i].until.Equal(gone[j].until) {
+			return gone[i].until.Before(gone[j].until)
+		}
+
+		return gone[i].Addr < gone[j].Addr
+	})
+
+	// the oldest endpoints are dropped first
+	if g.max > 0 && len(gone) > g.max {
+		for _, e := range gone[:len(gone)-g.max] {
+			delete(g.gone, instanceID(e.Entry))
+		}
+
+		gone = gone[len(gone)-g.max:]
+	}
+
+	out := make([]Endpoint, 0, len(g.current)+len(gone))
+	out = append(out, g.current...)
+	for _, e := range gone {
+		out = append(out, e.Endpoint)
+	}
+
+	return out
+}
+
+// nextExpiry returns the time when the next retained endpoint expires.
+func (g *graceKeeper) nextExpiry() (time.Time, bool) {
+	var next time.Time
+	for _, e := range g.gone {
+		if next.IsZero() || e.until.Before(next) {
+			next = e.until
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// retain forwards endpoints from in into the returned channel keeping the
+// disappeared ones for the grace period. Endpoints are resent when it expires.
+func retain(ctx context.Context, in <-chan []Endpoint, period time.Duration, max int) <-chan []Endpoint {
+	out := make(chan []Endpoint, 1)
+
+	go func() {
+		defer close(out)
+
+		g := newGraceKeeper(period, max)
+		for {
+			var expire <-chan time.Time
+			if next, ok := g.nextExpiry(); ok {
+				expire = time.After(time.Until(next))
+			}
+
+			var endpoints []Endpoint
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+
+				endpoints = g.update(v, time.Now())
+			case <-expire:
+				endpoints = g.endpoints(time.Now())
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case out <- endpoints:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,129 @@
+package consul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestGraceKeeper(t *testing.T) {
+	t.Parallel()
+
+	endpoint := func(node string, port int) Endpoint {
+		return newEndpoint(&api.ServiceEntry{
+			Node:    &api.Node{Node: node},
+			Service: &api.AgentService{ID: "svc", Address: "127.0.0.1", Port: port},
+		})
+	}
+
+	draining := func(e Endpoint) Endpoint {
+		e.Draining = true
+		return e
+	}
+
+	now := time.Unix(1000, 0)
+
+	t.Run("retained until expired", func(t *testing.T) {
+		t.Parallel()
+
+		g := newGraceKeeper(10*time.Second, 0)
+		require.Equal(t, []Endpoint{endpoint("n1", 1), endpoint("n2", 2)},
+			g.update([]Endpoint{endpoint("n1", 1), endpoint("n2", 2)}, now))
+
+		require.Equal(t, []Endpoint{endpoint("n1", 1), draining(endpoint("n2", 2))},
+			g.update([]Endpoint{endpoint("n1", 1)}, now.Add(time.Second)))
+
+		next, ok := g.nextExpiry()
+		require.True(t, ok)
+		require.Equal(t, now.Add(11*time.Second), next)
+
+		require.Equal(t, []Endpoint{endpoint("n1", 1), draining(endpoint("n2", 2))},
+			g.endpoints(now.Add(10*time.Second)))
+		require.Equal(t, []Endpoint{endpoint("n1", 1)}, g.endpoints(now.Add(11*time.Second)))
+
+		_, ok = g.nextExpiry()
+		require.False(t, ok)
+	})
+
+	t.Run("came back", func(t *testing.T) {
+		t.Parallel()
+
+		g := newGraceKeeper(10*time.Second, 0)
+		g.update([]Endpoint{endpoint("n1", 1), endpoint("n2", 2)}, now)
+		g.update([]Endpoint{endpoint("n1", 1)}, now.Add(time.Second))
+
+		require.Equal(t, []Endpoint{endpoint("n2", 2), endpoint("n1", 1)},
+			g.update([]Endpoint{endpoint("n2", 2), endpoint("n1", 1)}, now.Add(2*time.Second)))
+
+		_, ok := g.nextExpiry()
+		require.False(t, ok)
+	})
+
+	t.Run("address is taken", func(t *testing.T) {
+		t.Parallel()
+
+		g := newGraceKeeper(10*time.Second, 0)
+		g.update([]Endpoint{endpoint("n1", 1)}, now)
+
+		require.Equal(t, []Endpoint{endpoint("n2", 1)}, g.update([]Endpoint{endpoint("n2", 1)}, now))
+	})
+
+	t.Run("max retained", func(t *testing.T) {
+		t.Parallel()
+
+		g := newGraceKeeper(10*time.Second, 2)
+		g.update([]Endpoint{endpoint("n1", 1)}, now)
+		g.update([]Endpoint{endpoint("n2", 2)}, now.Add(time.Second))
+		g.update([]Endpoint{endpoint("n3", 3)}, now.Add(2*time.Second))
+
+		require.Equal(t, []Endpoint{endpoint("n4", 4), draining(endpoint("n2", 2)), draining(endpoint("n3", 3))},
+			g.update([]Endpoint{endpoint("n4", 4)}, now.Add(3*time.Second)))
+	})
+}
+
+func TestRetain(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	e1 := newEndpoint(&api.ServiceEntry{Service: &api.AgentService{ID: "1", Address: "127.0.0.1", Port: 1}})
+	e2 := newEndpoint(&api.ServiceEntry{Service: &api.AgentService{ID: "2", Address: "127.0.0.1", Port: 2}})
+
+	in := make(chan []Endpoint)
+	out := retain(ctx, in, 20*time.Millisecond, 0)
+
+	receive := func() []Endpoint {
+		select {
+		case got := <-out:
+			return got
+		case <-time.After(time.Second):
+			t.Fatal("nothing has been received")
+			return nil
+		}
+	}
+
+	in <- []Endpoint{e1, e2}
+	require.Equal(t, []Endpoint{e1, e2}, receive())
+
+	in <- []Endpoint{e1}
+	got := receive()
+	require.Len(t, got, 2)
+	require.True(t, got[1].Draining)
+	require.True(t, IsDraining(got[1].address()))
+	require.False(t, IsDraining(got[0].address()))
+
+	// resent without input when the grace period expires
+	require.Equal(t, []Endpoint{e1}, receive())
+}
+
+func TestIsDraining(t *testing.T) {
+	t.Parallel()
+
+	require.False(t, IsDraining(resolver.Address{Addr: "127.0.0.1:1"}))
+	require.True(t, IsDraining(Endpoint{Addr: "127.0.0.1:1", Draining: true}.address()))
+}
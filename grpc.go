@@ -2,20 +2,14 @@ package consul
 
 import (
 	"context"
-	"fmt"
 
-	"github.com/hashicorp/consul/api"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 )
 
 //go:generate mockgen -package=consul -destination=client_conn_mock_test.go google.golang.org/grpc/resolver ClientConn
 
-// init function for resolver registration.
-func init() {
-	resolver.Register(&builder{})
-}
-
 type grpcResolver struct {
 	r      *Resolver
 	cancel context.CancelFunc
@@ -30,24 +24,43 @@ func (r grpcResolver) Close() {
 }
 
 // builder implements resolver.Builder and is used for constructing all consul resolvers.
-type builder struct{}
+type builder struct {
+	opts []Option
+}
+
+// NewBuilder returns resolver.Builder which applies passed options to every
+// resolver it builds. It's intended to be used with grpc.WithResolvers when
+// the package-wide registration doesn't fit, e.g. to inject a logger or a
+// preconfigured Consul client.
+func NewBuilder(opts ...Option) resolver.Builder {
+	return &builder{opts: opts}
+}
 
 func (b *builder) Build(
 	target resolver.Target,
 	cc resolver.ClientConn,
 	_ resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r, err := NewResolver(target.URL.String(), WithLogger(grpcGlobalLogger{}))
+	opts := append([]Option{WithLogger(grpcGlobalLogger{})}, b.opts...)
+	opts = append(opts, withErrorHandler(cc.ReportError))
+
+	r, err := NewResolver(target.URL.String(), opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	// weights of the services are applied by the weighted balancer
+	var sc *serviceconfig.ParseResult
+	if len(r.t.serviceList()) > 1 {
+		sc = cc.ParseServiceConfig(weightedServiceConfig)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	pipe := r.WatchServiceChanges(ctx)
+	pipe := r.WatchEndpoints(ctx)
 
-	go populateEndpoints(ctx, cc, pipe)
+	go populateEndpoints(ctx, cc, pipe, sc)
 
-	return &grpcResolver{cancel: cancel}, nil
+	return &grpcResolver{r: r, cancel: cancel}, nil
 }
 
 // Scheme returns the scheme supported by this resolver.
@@ -56,18 +69,24 @@ func (b *builder) Scheme() string {
 	return schemeName
 }
 
-func populateEndpoints(ctx context.Context, clientConn resolver.ClientConn, input <-chan []*api.ServiceEntry) {
+func populateEndpoints(ctx context.Context, clientConn resolver.ClientConn, input <-chan []Endpoint, sc *serviceconfig.ParseResult) {
+	var last []resolver.Address
 	for {
 		select {
 		case in := <-input:
 			addrs := make([]resolver.Address, 0, len(in))
-			for _, s := range in {
-				addrs = append(addrs, resolver.Address{
-					Addr: fmt.Sprintf("%s:%d", s.Service.Address, s.Service.Port),
-				})
+			for _, e := range in {
+				addrs = append(addrs, e.address())
+			}
+
+			// changes of tags, meta or checks don't matter for gRPC
+			if last != nil && equalAddresses(last, addrs) {
+				continue
 			}
 
-			if err := clientConn.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+			last = addrs
+
+			if err := clientConn.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: sc}); err != nil {
 				grpclog.Errorf("failed to update connection stats: %v", err)
 			}
 		case <-ctx.Done():
@@ -76,3 +95,17 @@ func populateEndpoints(ctx context.Context, clientConn resolver.ClientConn, inpu
 		}
 	}
 }
+
+func equalAddresses(a, b []resolver.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,11 +2,14 @@ package consul
 
 import (
 	"context"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/consul/api"
+	"github.com/mbobakov/grpc-consul-resolver/consultest"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/resolver"
 )
 
@@ -87,12 +90,80 @@ func TestPopulateEndpoints(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			t.Cleanup(cancel)
 
-			in := make(chan []*api.ServiceEntry, 1)
-			in <- tc.input
+			in := make(chan []Endpoint, 1)
+			in <- newEndpoints(tc.input)
 
-			go populateEndpoints(ctx, clientConnMock, in)
+			go populateEndpoints(ctx, clientConnMock, in, nil)
 
 			time.Sleep(time.Millisecond)
 		})
 	}
 }
+
+func TestPopulateEndpointsSkipsSameAddresses(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	clientConnMock := NewMockClientConn(ctrl)
+	gomock.InOrder(
+		clientConnMock.EXPECT().UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: "127.0.0.1:50051"}}}),
+		clientConnMock.EXPECT().UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: "127.0.0.1:50052"}}}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	in := make(chan []Endpoint)
+	go populateEndpoints(ctx, clientConnMock, in, nil)
+
+	in <- newEndpoints([]*api.ServiceEntry{
+		{Service: &api.AgentService{Address: "127.0.0.1", Port: 50051}},
+	})
+	in <- newEndpoints([]*api.ServiceEntry{
+		{Service: &api.AgentService{Address: "127.0.0.1", Port: 50051, Tags: []string{"green"}}},
+	})
+	in <- newEndpoints([]*api.ServiceEntry{
+		{Service: &api.AgentService{Address: "127.0.0.1", Port: 50052}},
+	})
+
+	time.Sleep(time.Millisecond)
+}
+
+func TestNewBuilder(t *testing.T) {
+	t.Parallel()
+
+	srv := consultest.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.Register(&api.ServiceEntry{Service: &api.AgentService{Service: "svc", Address: "127.0.0.1", Port: 50051}})
+
+	client, err := api.NewClient(srv.Config())
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	clientConnMock := NewMockClientConn(ctrl)
+	clientConnMock.EXPECT().ReportError(gomock.Any()).AnyTimes()
+
+	updated := make(chan struct{})
+	clientConnMock.EXPECT().
+		UpdateState(resolver.State{Addresses: []resolver.Address{{Addr: "127.0.0.1:50051"}}}).
+		Do(func(resolver.State) { close(updated) })
+
+	// the address from the target is unreachable, so
+	// the passed client must be used for all the requests
+	b := NewBuilder(WithConsulClient(client))
+	require.Equal(t, schemeName, b.Scheme())
+
+	u, err := url.Parse("consul://127.0.0.1:1/svc")
+	require.NoError(t, err)
+
+	r, err := b.Build(resolver.Target{URL: *u}, clientConnMock, resolver.BuildOptions{})
+	require.NoError(t, err)
+	t.Cleanup(r.Close)
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("state hasn't been updated")
+	}
+}
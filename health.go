@@ -0,0 +1,91 @@
+package consul
+
+import "github.com/hashicorp/consul/api"
+
+// Health modes of the target, see healthMode.
+const (
+	healthPassing = "passing"
+	healthWarning = "warning"
+	healthAny     = "any"
+)
+
+// healthPolicy decides whether the instance is healthy by its checks.
+type healthPolicy struct {
+	// allowWarning keeps instances with warning checks.
+	allowWarning bool
+	// ignored are IDs of the checks which don't affect the decision.
+	ignored map[string]bool
+	// ignoreMaintenance keeps instances in maintenance mode.
+	ignoreMaintenance bool
+}
+
+// healthy reports whether the entry is healthy. Checks are aggregated as
+// by Consul: maintenance beats critical, critical beats warning.
+func (p healthPolicy) healthy(e *api.ServiceEntry) bool {
+	checks := e.Checks
+	if len(p.ignored) > 0 || p.ignoreMaintenance {
+		checks = make(api.HealthChecks, 0, len(e.Checks))
+		for _, c := range e.Checks {
+			if !p.ignored[c.CheckID] && !(p.ignoreMaintenance && isMaintenanceCheck(c.CheckID)) {
+				checks = append(checks, c)
+			}
+		}
+	}
+
+	switch checks.AggregatedStatus() {
+	case api.HealthPassing:
+		return true
+	case api.HealthWarning:
+		return p.allowWarning
+	default:
+		return false
+	}
+}
+
+// selectHealthy returns the entries healthy according to the policy. If the
+// percentage of such entries is below the threshold, all the entries are returned
+// and panicking is true, so the load is spread over all the registered instances.
+func selectHealthy(entries []*api.ServiceEntry, p healthPolicy, threshold int) (_ []*api.ServiceEntry, panicking bool) {
+	healthy := make([]*api.ServiceEntry, 0, len(entries))
+	for _, e := range entries {
+		if p.healthy(e) {
+			healthy = append(healthy, e)
+		}
+	}
+
+	if len(entries) > 0 && len(healthy)*100 < threshold*len(entries) {
+		return entries, true
+	}
+
+	return healthy, false
+}
+
+// healthMode returns the health mode of the target.
+// 'healthy=true' is a shortcut for 'health=passing'.
+func (t *Target) healthMode() string {
+	switch {
+	case t.Health != "":
+		return t.Health
+	case t.Healthy:
+		return healthPassing
+	default:
+		return healthAny
+	}
+}
+
+// healthPolicy returns the policy of the client-side health checking.
+func (t *Target) healthPolicy() healthPolicy {
+	p := healthPolicy{
+		allowWarning:      t.healthMode() == healthWarning,
+		ignoreMaintenance: t.IncludeMaintenance,
+	}
+
+	if len(t.ignoredChecks) > 0 {
+		p.ignored = make(map[string]bool, len(t.ignoredChecks))
+		for _, id := range t.ignoredChecks {
+			p.ignored[id] = true
+		}
+	}
+
+	return p
+}
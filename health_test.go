@@ -0,0 +1,219 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectHealthy(t *testing.T) {
+	t.Parallel()
+
+	entry := func(port int, status string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Service: &api.AgentService{Address: "127.0.0.1", Port: port},
+			Checks:  api.HealthChecks{{CheckID: "serfHealth", Status: status}},
+		}
+	}
+
+	all := []*api.ServiceEntry{
+		entry(1, api.HealthPassing),
+		entry(2, api.HealthCritical),
+		entry(3, api.HealthWarning),
+		entry(4, api.HealthPassing),
+	}
+
+	tt := []struct {
+		name          string
+		in            []*api.ServiceEntry
+		threshold     int
+		expect        []*api.ServiceEntry
+		expectPanicky bool
+	}{
+		{
+			name:      "empty",
+			threshold: 50,
+			expect:    []*api.ServiceEntry{},
+		},
+		{
+			name:      "at threshold",
+			in:        all,
+			threshold: 50,
+			expect:    []*api.ServiceEntry{entry(1, api.HealthPassing), entry(4, api.HealthPassing)},
+		},
+		{
+			name:          "below threshold",
+			in:            all,
+			threshold:     51,
+			expect:        all,
+			expectPanicky: true,
+		},
+		{
+			name:          "nothing healthy",
+			in:            []*api.ServiceEntry{entry(1, api.HealthCritical)},
+			threshold:     1,
+			expect:        []*api.ServiceEntry{entry(1, api.HealthCritical)},
+			expectPanicky: true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, panicking := selectHealthy(tc.in, healthPolicy{}, tc.threshold)
+			require.Equal(t, tc.expect, actual)
+			require.Equal(t, tc.expectPanicky, panicking)
+		})
+	}
+}
+
+func TestHealthPolicy(t *testing.T) {
+	t.Parallel()
+
+	entry := func(checks ...*api.HealthCheck) *api.ServiceEntry {
+		return &api.ServiceEntry{Service: &api.AgentService{Address: "127.0.0.1", Port: 1}, Checks: checks}
+	}
+
+	serf := func(status string) *api.HealthCheck {
+		return &api.HealthCheck{CheckID: "serfHealth", Status: status}
+	}
+
+	grpc := func(status string) *api.HealthCheck {
+		return &api.HealthCheck{CheckID: "grpc", Status: status}
+	}
+
+	tt := []struct {
+		name   string
+		dsn    string
+		in     *api.ServiceEntry
+		expect bool
+	}{
+		{
+			name:   "passing",
+			dsn:    "consul://127.0.0.1/s?health=passing",
+			in:     entry(serf(api.HealthPassing), grpc(api.HealthPassing)),
+			expect: true,
+		},
+		{
+			name: "warning isn't passing",
+			dsn:  "consul://127.0.0.1/s?healthy=true",
+			in:   entry(serf(api.HealthPassing), grpc(api.HealthWarning)),
+		},
+		{
+			name:   "warning is accepted",
+			dsn:    "consul://127.0.0.1/s?health=warning",
+			in:     entry(serf(api.HealthPassing), grpc(api.HealthWarning)),
+			expect: true,
+		},
+		{
+			name: "critical beats warning",
+			dsn:  "consul://127.0.0.1/s?health=warning",
+			in:   entry(serf(api.HealthCritical), grpc(api.HealthWarning)),
+		},
+		{
+			name:   "critical check is ignored",
+			dsn:    "consul://127.0.0.1/s?health=passing&ignore-checks=serfHealth",
+			in:     entry(serf(api.HealthCritical), grpc(api.HealthPassing)),
+			expect: true,
+		},
+		{
+			name: "other checks aren't ignored",
+			dsn:  "consul://127.0.0.1/s?health=passing&ignore-checks=serfHealth,flaky",
+			in:   entry(serf(api.HealthCritical), grpc(api.HealthCritical)),
+		},
+		{
+			name: "maintenance is critical",
+			dsn:  "consul://127.0.0.1/s?health=warning",
+			in:   entry(serf(api.HealthPassing), &api.HealthCheck{CheckID: "_node_maintenance", Status: api.HealthCritical}),
+		},
+		{
+			name:   "maintenance is included",
+			dsn:    "consul://127.0.0.1/s?health=passing&include-maintenance=true",
+			in:     entry(serf(api.HealthPassing), &api.HealthCheck{CheckID: "_service_maintenance:s-1", Status: api.HealthCritical}),
+			expect: true,
+		},
+		{
+			name:   "no checks",
+			dsn:    "consul://127.0.0.1/s?health=passing&ignore-checks=serfHealth",
+			in:     entry(serf(api.HealthCritical)),
+			expect: true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tgt, err := ParseTarget(tc.dsn)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, tgt.healthPolicy().healthy(tc.in))
+		})
+	}
+}
+
+func TestResolver_ClientSideHealth(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name             string
+		dsn              string
+		expectClientSide bool
+	}{
+		{
+			name: "any",
+			dsn:  "consul://127.0.0.1/s",
+		},
+		{
+			name:             "healthy",
+			dsn:              "consul://127.0.0.1/s?healthy=true",
+			expectClientSide: true,
+		},
+		{
+			name:             "passing",
+			dsn:              "consul://127.0.0.1/s?health=passing",
+			expectClientSide: true,
+		},
+		{
+			name:             "warning",
+			dsn:              "consul://127.0.0.1/s?health=warning",
+			expectClientSide: true,
+		},
+		{
+			name:             "ignored checks",
+			dsn:              "consul://127.0.0.1/s?healthy=true&ignore-checks=serfHealth",
+			expectClientSide: true,
+		},
+		{
+			name:             "panic threshold",
+			dsn:              "consul://127.0.0.1/s?health=passing&panic-threshold=50",
+			expectClientSide: true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tgt, err := ParseTarget(tc.dsn)
+			require.NoError(t, err)
+
+			ctrl := gomock.NewController(t)
+			mockConsul := NewMockConsul(ctrl)
+			// maintenance is reported only if Consul doesn't drop it with passingOnly
+			mockConsul.EXPECT().ServiceMultipleTags("s", nil, false, gomock.Any()).
+				Return(nil, &api.QueryMeta{LastIndex: 1}, nil)
+
+			r := &Resolver{t: &tgt, c: mockConsul}
+			require.Equal(t, tc.expectClientSide, r.clientSideHealth())
+
+			_, _, err = r.fetch("s", nil)
+			require.NoError(t, err)
+		})
+	}
+}
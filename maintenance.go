@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// IDs of the critical checks added by Consul to the instances in maintenance mode.
+const (
+	nodeMaintenanceCheckID        = "_node_maintenance"
+	serviceMaintenanceCheckPrefix = "_service_maintenance:"
+)
+
+// Kinds of the maintenance reported in metrics.
+const (
+	maintenanceNode    = "node"
+	maintenanceService = "service"
+)
+
+// isMaintenanceCheck reports whether the check is added by the maintenance mode.
+func isMaintenanceCheck(id string) bool {
+	return id == nodeMaintenanceCheckID || strings.HasPrefix(id, serviceMaintenanceCheckPrefix)
+}
+
+// maintenance returns the kind of the maintenance of the entry and the reason
+// given by the operator. Maintenance of the node beats the service one.
+func maintenance(e *api.ServiceEntry) (kind, reason string, ok bool) {
+	for _, c := range e.Checks {
+		switch {
+		case c.CheckID == nodeMaintenanceCheckID:
+			return maintenanceNode, c.Notes, true
+		case strings.HasPrefix(c.CheckID, serviceMaintenanceCheckPrefix):
+			kind, reason, ok = maintenanceService, c.Notes, true
+		}
+	}
+
+	return kind, reason, ok
+}
+
+// excludeMaintenance drops the entries in maintenance mode. Reasons of
+// the exclusion are kept in the state of the service, newly excluded
+// instances are logged and counted.
+func (r *Resolver) excludeMaintenance(service string, entries []*api.ServiceEntry) []*api.ServiceEntry {
+	var (
+		kept     = make([]*api.ServiceEntry, 0, len(entries))
+		excluded = make(map[string]string)
+		kinds    = make(map[string]string)
+	)
+
+	for _, e := range entries {
+		kind, reason, ok := maintenance(e)
+		if !ok {
+			kept = append(kept, e)
+			continue
+		}
+
+		id := instanceID(e).String()
+		excluded[id] = kind + " maintenance"
+		if reason != "" {
+			excluded[id] += ": " + reason
+		}
+
+		kinds[id] = kind
+	}
+
+	previous := r.recordExcluded(service, excluded)
+	for id, reason := range excluded {
+		if _, ok := previous[id]; ok {
+			continue
+		}
+
+		r.logger.Infof("[Consul resolver] Instance %s of '%s' is excluded due to %s. target={%s}", id, service, reason, r.t.String())
+		r.metrics.IncrCounter(withLabel(metricMaintenanceExcluded, kinds[id]), 1)
+	}
+
+	return kept
+}
@@ -0,0 +1,165 @@
+package consul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	t.Parallel()
+
+	nodeMaint := &api.HealthCheck{CheckID: "_node_maintenance", Status: api.HealthCritical, Notes: "kernel upgrade"}
+	serviceMaint := &api.HealthCheck{CheckID: "_service_maintenance:svc-1", Status: api.HealthCritical, Notes: "migration"}
+
+	tt := []struct {
+		name         string
+		checks       api.HealthChecks
+		expectKind   string
+		expectReason string
+		expectOK     bool
+	}{
+		{
+			name:   "no maintenance",
+			checks: api.HealthChecks{{CheckID: "serfHealth", Status: api.HealthCritical}},
+		},
+		{
+			name:         "node",
+			checks:       api.HealthChecks{nodeMaint},
+			expectKind:   maintenanceNode,
+			expectReason: "kernel upgrade",
+			expectOK:     true,
+		},
+		{
+			name:         "service",
+			checks:       api.HealthChecks{serviceMaint},
+			expectKind:   maintenanceService,
+			expectReason: "migration",
+			expectOK:     true,
+		},
+		{
+			name:         "node beats service",
+			checks:       api.HealthChecks{serviceMaint, nodeMaint},
+			expectKind:   maintenanceNode,
+			expectReason: "kernel upgrade",
+			expectOK:     true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			kind, reason, ok := maintenance(&api.ServiceEntry{Checks: tc.checks})
+			require.Equal(t, tc.expectKind, kind)
+			require.Equal(t, tc.expectReason, reason)
+			require.Equal(t, tc.expectOK, ok)
+		})
+	}
+}
+
+func TestResolver_LookupMaintenance(t *testing.T) {
+	t.Parallel()
+
+	entries := []*api.ServiceEntry{
+		{
+			Node:    &api.Node{Node: "node-1"},
+			Service: &api.AgentService{ID: "svc-1", Address: "127.0.0.1", Port: 1},
+		},
+		{
+			Node:    &api.Node{Node: "node-2"},
+			Service: &api.AgentService{ID: "svc-2", Address: "127.0.0.2", Port: 1},
+			Checks:  api.HealthChecks{{CheckID: "_node_maintenance", Status: api.HealthCritical, Notes: "kernel upgrade"}},
+		},
+		{
+			Node:    &api.Node{Node: "node-3"},
+			Service: &api.AgentService{ID: "svc-3", Address: "127.0.0.3", Port: 1},
+			Checks:  api.HealthChecks{{CheckID: "_service_maintenance:svc-3", Status: api.HealthCritical}},
+		},
+	}
+
+	tt := []struct {
+		name           string
+		dsn            string
+		passingOnly    bool
+		expectAddrs    []string
+		expectExcluded map[string]string
+		expectCounted  float32
+	}{
+		{
+			name:        "excluded regardless of health",
+			dsn:         "consul://127.0.0.1/svc",
+			expectAddrs: []string{"127.0.0.1:1"},
+			expectExcluded: map[string]string{
+				"node-2/svc-2": "node maintenance: kernel upgrade",
+				"node-3/svc-3": "service maintenance",
+			},
+			expectCounted: 1,
+		},
+		{
+			name:        "excluded and reported with healthy",
+			dsn:         "consul://127.0.0.1/svc?healthy=true",
+			expectAddrs: []string{"127.0.0.1:1"},
+			expectExcluded: map[string]string{
+				"node-2/svc-2": "node maintenance: kernel upgrade",
+				"node-3/svc-3": "service maintenance",
+			},
+			expectCounted: 1,
+		},
+		{
+			name:        "included",
+			dsn:         "consul://127.0.0.1/svc?include-maintenance=true",
+			expectAddrs: []string{"127.0.0.1:1", "127.0.0.2:1", "127.0.0.3:1"},
+		},
+		{
+			name:        "included and healthy",
+			dsn:         "consul://127.0.0.1/svc?include-maintenance=true&healthy=true",
+			expectAddrs: []string{"127.0.0.1:1", "127.0.0.2:1", "127.0.0.3:1"},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tgt, err := ParseTarget(tc.dsn)
+			require.NoError(t, err)
+
+			ctrl := gomock.NewController(t)
+			mockConsul := NewMockConsul(ctrl)
+			mockConsul.EXPECT().ServiceMultipleTags("svc", nil, tc.passingOnly, gomock.Any()).
+				Return(entries, &api.QueryMeta{LastIndex: 1}, nil).Times(2)
+
+			metrics := newMetricsRecorder()
+			s := &Resolver{
+				logger:  noopLogger{},
+				metrics: metrics,
+				onError: func(error) {},
+				t:       &tgt,
+				c:       mockConsul,
+			}
+
+			for i := 0; i < 2; i++ {
+				got, err := s.Lookup(context.Background())
+				require.NoError(t, err)
+
+				addrs := make([]string, 0, len(got))
+				for _, e := range got {
+					addrs = append(addrs, e.Addr)
+				}
+
+				require.Equal(t, tc.expectAddrs, addrs)
+				require.Equal(t, tc.expectExcluded, s.State().Services["svc"].Excluded)
+			}
+
+			// repeated exclusion isn't counted
+			require.Equal(t, tc.expectCounted, metrics.counter(withLabel(metricMaintenanceExcluded, maintenanceNode)))
+			require.Equal(t, tc.expectCounted, metrics.counter(withLabel(metricMaintenanceExcluded, maintenanceService)))
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package consul
+
+import "github.com/armon/go-metrics"
+
+// Metrics is used to report resolver events.
+type Metrics interface {
+	IncrCounter(key []string, val float32)
+	SetGauge(key []string, val float32)
+}
+
+type noopMetrics struct{}
+
+// IncrCounter does nothing.
+func (n noopMetrics) IncrCounter(_ []string, _ float32) {
+}
+
+// SetGauge does nothing.
+func (n noopMetrics) SetGauge(_ []string, _ float32) {
+}
+
+// ensure Metrics method set is a subset of go-metrics sink.
+var _ Metrics = (*metrics.Metrics)(nil)
+
+// metric keys reported by the resolver.
+var (
+	metricPanicMode          = []string{"grpc_consul_resolver", "panic_mode"}
+	metricEmptyUpdateIgnored = []string{"grpc_consul_resolver", "empty_update_ignored"}
+	// the kind of the maintenance is appended to the key
+	metricMaintenanceExcluded = []string{"grpc_consul_resolver", "maintenance_excluded"}
+)
+
+// withLabel returns the copy of the key with the label appended.
+func withLabel(key []string, label string) []string {
+	return append(append(make([]string, 0, len(key)+1), key...), label)
+}
+
+func boolGauge(v bool) float32 {
+	if v {
+		return 1
+	}
+
+	return 0
+}
+
+func anyTrue(m map[string]bool) bool {
+	for _, v := range m {
+		if v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,5 +1,7 @@
 package consul
 
+import "github.com/hashicorp/consul/api"
+
 // Option is used to configure Resolver.
 type Option func(r *Resolver)
 
@@ -9,3 +11,85 @@ func WithLogger(l Logger) Option {
 		r.logger = l
 	}
 }
+
+// WithMetrics sets metrics sink.
+func WithMetrics(m Metrics) Option {
+	return func(r *Resolver) {
+		r.metrics = m
+	}
+}
+
+// WithZone sets the zone of the client used by sort=sameZoneFirst.
+// By default it's taken from the GRPC_CONSUL_RESOLVER_ZONE environment variable.
+func WithZone(zone string) Option {
+	return func(r *Resolver) {
+		r.zone = zone
+	}
+}
+
+// WithClientID sets the identity of the client used by subset.
+// Clients with the same identity get the same subset. Hostname is used by default.
+func WithClientID(id string) Option {
+	return func(r *Resolver) {
+		r.clientID = id
+	}
+}
+
+// WithConsulClient sets Consul client to be used instead of the one
+// constructed from the target. Connection parameters of the target
+// (address, credentials, token, timeout, TLS) are ignored in this case.
+func WithConsulClient(c *api.Client) Option {
+	return func(r *Resolver) {
+		r.client = c
+	}
+}
+
+// WithTokenProvider sets the source of the Consul ACL token which is asked
+// before every request to Consul, e.g. to follow rotation of short-lived tokens.
+// It overrides the token of the target and is ignored with WithConsulClient.
+func WithTokenProvider(p TokenProvider) Option {
+	return func(r *Resolver) {
+		r.tokenProvider = p
+	}
+}
+
+// withErrorHandler sets the function which is called on
+// every error occurred in the background, e.g. to report it to gRPC.
+func withErrorHandler(f func(error)) Option {
+	return func(r *Resolver) {
+		r.onError = f
+	}
+}
+
+// AgentOption is used to configure Authorizer, Registrar and ConnectCredentials.
+type AgentOption func(o *agentOptions)
+
+// agentOptions are the connection related options of agentClient.
+type agentOptions struct {
+	logger        Logger
+	client        *api.Client
+	tokenProvider TokenProvider
+}
+
+// WithAgentLogger sets logger.
+func WithAgentLogger(l Logger) AgentOption {
+	return func(o *agentOptions) {
+		o.logger = l
+	}
+}
+
+// WithAgentConsulClient sets Consul client to be used instead of the one
+// constructed from the DSN, see WithConsulClient.
+func WithAgentConsulClient(c *api.Client) AgentOption {
+	return func(o *agentOptions) {
+		o.client = c
+	}
+}
+
+// WithAgentTokenProvider sets the source of the Consul ACL token,
+// see WithTokenProvider. It's ignored with WithAgentConsulClient.
+func WithAgentTokenProvider(p TokenProvider) AgentOption {
+	return func(o *agentOptions) {
+		o.tokenProvider = p
+	}
+}
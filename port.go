@@ -0,0 +1,51 @@
+package consul
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const maxPort = 65535
+
+// port returns the port of the instance chosen by port or port-meta parameters.
+func (t *Target) port(e *api.ServiceEntry) (int, error) {
+	switch {
+	case t.Port != 0:
+		return t.Port, nil
+	case t.PortMeta != "":
+		v, ok := e.Service.Meta[t.PortMeta]
+		if !ok {
+			return 0, fmt.Errorf("no '%s' in service meta", t.PortMeta)
+		}
+
+		port, err := strconv.Atoi(v)
+		if err != nil || port <= 0 || port > maxPort {
+			return 0, fmt.Errorf("invalid port '%s' in '%s' service meta", v, t.PortMeta)
+		}
+
+		return port, nil
+	default:
+		return e.Service.Port, nil
+	}
+}
+
+// selectPorts drops the instances without valid port-meta.
+func (r *Resolver) selectPorts(entries []*api.ServiceEntry) []*api.ServiceEntry {
+	if r.t.PortMeta == "" {
+		return entries
+	}
+
+	selected := make([]*api.ServiceEntry, 0, len(entries))
+	for _, e := range entries {
+		if _, err := r.t.port(e); err != nil {
+			r.logger.Errorf("[Consul resolver] Skipping instance %s. target={%s}; error={%v}", instanceID(e), r.t.String(), err)
+			continue
+		}
+
+		selected = append(selected, e)
+	}
+
+	return selected
+}
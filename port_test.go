@@ -0,0 +1,97 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarget_Port(t *testing.T) {
+	t.Parallel()
+
+	entry := func(meta map[string]string) *api.ServiceEntry {
+		return &api.ServiceEntry{Service: &api.AgentService{Address: "127.0.0.1", Port: 8080, Meta: meta}}
+	}
+
+	tt := []struct {
+		name        string
+		target      Target
+		in          *api.ServiceEntry
+		expect      int
+		expectError bool
+	}{
+		{
+			name:   "service port",
+			in:     entry(nil),
+			expect: 8080,
+		},
+		{
+			name:   "static port",
+			target: Target{Port: 9090},
+			in:     entry(map[string]string{"grpc_port": "9091"}),
+			expect: 9090,
+		},
+		{
+			name:   "meta port",
+			target: Target{PortMeta: "grpc_port"},
+			in:     entry(map[string]string{"grpc_port": "9091"}),
+			expect: 9091,
+		},
+		{
+			name:        "no meta port",
+			target:      Target{PortMeta: "grpc_port"},
+			in:          entry(map[string]string{"http_port": "9091"}),
+			expectError: true,
+		},
+		{
+			name:        "malformed meta port",
+			target:      Target{PortMeta: "grpc_port"},
+			in:          entry(map[string]string{"grpc_port": "grpc"}),
+			expectError: true,
+		},
+		{
+			name:        "meta port out of range",
+			target:      Target{PortMeta: "grpc_port"},
+			in:          entry(map[string]string{"grpc_port": "70000"}),
+			expectError: true,
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			port, err := tc.target.port(tc.in)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, port)
+		})
+	}
+}
+
+func TestResolver_SelectPorts(t *testing.T) {
+	t.Parallel()
+
+	valid := &api.ServiceEntry{Service: &api.AgentService{
+		ID:      "1",
+		Address: "127.0.0.1",
+		Port:    8080,
+		Meta:    map[string]string{"grpc_port": "9090"},
+	}}
+	invalid := &api.ServiceEntry{Service: &api.AgentService{ID: "2", Address: "127.0.0.2", Port: 8080}}
+
+	r := &Resolver{
+		logger: noopLogger{},
+		t:      &Target{PortMeta: "grpc_port"},
+	}
+
+	entries := r.selectPorts([]*api.ServiceEntry{invalid, valid})
+	require.Equal(t, []*api.ServiceEntry{valid}, entries)
+	require.Equal(t, []Endpoint{{Addr: "127.0.0.1:9090", Entry: valid}}, r.newEndpoints(entries))
+}
@@ -0,0 +1,12 @@
+//go:build !consul_resolver_no_register
+
+package consul
+
+import "google.golang.org/grpc/resolver"
+
+// init function for resolver registration.
+// Build with the consul_resolver_no_register tag to skip it
+// and pass NewBuilder to grpc.WithResolvers instead.
+func init() {
+	resolver.Register(NewBuilder())
+}
@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const defaultRegistrationInterval = 10 * time.Second
+
+// Registration describes the service instance registered by Registrar.
+type Registration struct {
+	// ID of the instance, defaults to 'name-hostname-port'.
+	ID      string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Weights *api.AgentWeights
+	Check   *api.AgentServiceCheck
+
+	// HealthServer enables the TTL check mirroring the serving status
+	// of HealthService (the whole server by default): SERVING is passing,
+	// anything else is critical. Heartbeats are sent every third of TTL, 10s by default.
+	HealthServer  healthpb.HealthServer
+	HealthService string
+	TTL           time.Duration
+}
+
+// Registrar keeps the gRPC server registered in Consul. The
+// registration is verified periodically and restored if the agent
+// has lost it, e.g. after the restart or by the anti-entropy sync.
+type Registrar struct {
+	c        *agentClient
+	reg      *api.AgentServiceRegistration
+	interval time.Duration
+
+	health        healthpb.HealthServer
+	healthService string
+	ttl           time.Duration
+	// registered is notified to update the TTL check right after the registration
+	registered chan struct{}
+}
+
+// NewRegistrar returns registrar of the instance of the service from the DSN
+// (e.g. 'consul://127.0.0.1:8500/payments'). Only the connection parameters
+// of the DSN and the passed options are used.
+func NewRegistrar(dsn string, reg Registration, opts ...AgentOption) (*Registrar, error) {
+	c, err := newAgentClient(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if reg.ID == "" {
+		hostname, _ := os.Hostname()
+		reg.ID = fmt.Sprintf("%s-%s-%d", c.service, hostname, reg.Port)
+	}
+
+	g := &Registrar{
+		c: c,
+		reg: &api.AgentServiceRegistration{
+			ID:      reg.ID,
+			Name:    c.service,
+			Address: reg.Address,
+			Port:    reg.Port,
+			Tags:    reg.Tags,
+			Meta:    reg.Meta,
+			Weights: reg.Weights,
+			Check:   reg.Check,
+		},
+		interval:      defaultRegistrationInterval,
+		health:        reg.HealthServer,
+		healthService: reg.HealthService,
+		ttl:           reg.TTL,
+		registered:    make(chan struct{}, 1),
+	}
+
+	if g.health != nil {
+		if g.ttl <= 0 {
+			g.ttl = defaultHealthTTL
+		}
+
+		g.reg.Checks = api.AgentServiceChecks{{
+			CheckID: ttlCheckID(reg.ID),
+			Name:    "gRPC health",
+			TTL:     g.ttl.String(),
+		}}
+	}
+
+	return g, nil
+}
+
+// ID returns the ID of the registered instance.
+func (g *Registrar) ID() string {
+	return g.reg.ID
+}
+
+// Run registers the instance and keeps it registered until passed context
+// is cancelled, then the instance is deregistered. It returns an error only
+// if the context is cancelled before the instance is registered or deregistration fails.
+func (g *Registrar) Run(ctx context.Context) error {
+	bck := newBackoff(g.c.maxBackoff)
+	for {
+		err := g.register()
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-time.After(bck.NextBackOff()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// the TTL check mustn't be updated after the deregistration,
+	// so the bridge is joined before it
+	bridged := make(chan struct{})
+	if g.health != nil {
+		go func() {
+			defer close(bridged)
+			g.bridgeHealth(ctx)
+		}()
+	} else {
+		close(bridged)
+	}
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			<-bridged
+			return g.deregister()
+		}
+
+		services, err := g.c.agent.Services()
+		if err != nil {
+			g.c.logger.Errorf("[Consul resolver] Couldn't verify registration of '%s'. target={%s}; error={%v}", g.reg.ID, g.c.target, err)
+			g.c.onError(fmt.Errorf("failed to verify registration of '%s': %w", g.reg.ID, err))
+
+			continue
+		}
+
+		if _, ok := services[g.reg.ID]; !ok {
+			g.c.logger.Infof("[Consul resolver] Registration of '%s' is lost, registering again. target={%s}", g.reg.ID, g.c.target)
+			_ = g.register()
+		}
+	}
+}
+
+func (g *Registrar) register() error {
+	if err := g.c.agent.ServiceRegister(g.reg); err != nil {
+		g.c.logger.Errorf("[Consul resolver] Couldn't register '%s'. target={%s}; error={%v}", g.reg.ID, g.c.target, err)
+		g.c.onError(fmt.Errorf("failed to register '%s': %w", g.reg.ID, err))
+
+		return err
+	}
+
+	g.c.logger.Infof("[Consul resolver] '%s' is registered. target={%s}", g.reg.ID, g.c.target)
+
+	select {
+	case g.registered <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (g *Registrar) deregister() error {
+	if err := g.c.agent.ServiceDeregister(g.reg.ID); err != nil {
+		return fmt.Errorf("failed to deregister '%s': %w", g.reg.ID, err)
+	}
+
+	g.c.logger.Infof("[Consul resolver] '%s' is deregistered. target={%s}", g.reg.ID, g.c.target)
+
+	return nil
+}
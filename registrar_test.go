@@ -0,0 +1,158 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/mbobakov/grpc-consul-resolver/consultest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRegistrar_Run(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	reg := &api.AgentServiceRegistration{
+		ID:      "payments-1",
+		Name:    "payments",
+		Address: "127.0.0.1",
+		Port:    50051,
+		Tags:    []string{"green"},
+		Meta:    map[string]string{"version": "1"},
+		Weights: &api.AgentWeights{Passing: 10, Warning: 1},
+		Check:   &api.AgentServiceCheck{TCP: "127.0.0.1:50051", Interval: "10s"},
+	}
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().ServiceRegister(reg).Return(errors.New("connection refused")),
+		mockAgent.EXPECT().ServiceRegister(reg).Return(nil),
+		// agent has restarted and lost the registration
+		mockAgent.EXPECT().Services().Return(map[string]*api.AgentService{}, nil),
+		mockAgent.EXPECT().ServiceRegister(reg).Return(nil),
+		mockAgent.EXPECT().Services().Return(map[string]*api.AgentService{"payments-1": {}}, nil).
+			Do(cancel).AnyTimes(),
+		mockAgent.EXPECT().ServiceDeregister("payments-1").Return(nil),
+	)
+
+	g := &Registrar{
+		c: &agentClient{
+			logger:     noopLogger{},
+			onError:    func(error) {},
+			service:    "payments",
+			maxBackoff: time.Second,
+			agent:      mockAgent,
+		},
+		reg:      reg,
+		interval: time.Millisecond,
+	}
+
+	require.NoError(t, g.Run(ctx))
+}
+
+func TestRegistrar_RunCancelledBeforeRegistration(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	mockAgent.EXPECT().ServiceRegister(gomock.Any()).Return(errors.New("connection refused")).Do(func(*api.AgentServiceRegistration) {
+		cancel()
+	})
+
+	g := &Registrar{
+		c: &agentClient{
+			logger:     noopLogger{},
+			onError:    func(error) {},
+			service:    "payments",
+			maxBackoff: time.Minute,
+			agent:      mockAgent,
+		},
+		reg:      &api.AgentServiceRegistration{ID: "payments-1", Name: "payments"},
+		interval: time.Millisecond,
+	}
+
+	require.ErrorIs(t, g.Run(ctx), context.Canceled)
+}
+
+func TestNewRegistrar(t *testing.T) {
+	t.Parallel()
+
+	g, err := NewRegistrar("consul://127.0.0.1:8500/payments?token=secret", Registration{
+		Address: "127.0.0.1",
+		Port:    50051,
+	})
+	require.NoError(t, err)
+	require.Contains(t, g.ID(), "payments-")
+	require.Contains(t, g.ID(), "-50051")
+	require.Equal(t, "payments", g.reg.Name)
+}
+
+func TestRegistrar_EndToEnd(t *testing.T) {
+	t.Parallel()
+
+	srv := consultest.NewServer()
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	dsn := "consul://" + srv.Addr() + "/payments"
+	g, err := NewRegistrar(dsn, Registration{
+		ID:           "payments-1",
+		Address:      "127.0.0.1",
+		Port:         50051,
+		HealthServer: hs,
+	})
+	require.NoError(t, err)
+
+	stopped := make(chan error)
+	runCtx, stop := context.WithCancel(ctx)
+	go func() { stopped <- g.Run(runCtx) }()
+
+	r, err := NewResolver(dsn + "?healthy=true")
+	require.NoError(t, err)
+
+	endpoints := r.WatchEndpoints(ctx)
+	waitFor := func(expect int) {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-endpoints:
+				if len(got) == expect {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("resolver hasn't got %d endpoints", expect)
+			}
+		}
+	}
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	waitFor(1)
+
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitFor(0)
+
+	stop()
+	require.NoError(t, <-stopped)
+
+	services, err := r.agent.Services()
+	require.NoError(t, err)
+	require.NotContains(t, services, "payments-1")
+}
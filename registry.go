@@ -0,0 +1,132 @@
+package consul
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Locality describes the client to sorters and filters.
+type Locality struct {
+	// Node is the name of the local agent node.
+	// It's empty until the agent is discovered.
+	Node string
+	// Zone is the zone of the client, see WithZone.
+	Zone string
+	// ZoneKey is the key of the node meta holding zone.
+	ZoneKey string
+	// RTT returns round trip time to the node estimated from network
+	// coordinates cached by the resolver. It doesn't fetch coordinates itself,
+	// the estimate is unknown for the nodes without cached ones.
+	RTT func(node string) (time.Duration, bool)
+}
+
+// Sorter sorts service entries in place.
+type Sorter interface {
+	Sort(l Locality, entries []*api.ServiceEntry)
+}
+
+// SorterFunc is an adapter to use ordinary functions as Sorter.
+type SorterFunc func(l Locality, entries []*api.ServiceEntry)
+
+// Sort calls f(l, entries).
+func (f SorterFunc) Sort(l Locality, entries []*api.ServiceEntry) {
+	f(l, entries)
+}
+
+// Filter decides whether the service entry is passed to gRPC.
+type Filter interface {
+	Keep(l Locality, e *api.ServiceEntry) bool
+}
+
+// FilterFunc is an adapter to use ordinary functions as Filter.
+type FilterFunc func(l Locality, e *api.ServiceEntry) bool
+
+// Keep calls f(l, e).
+func (f FilterFunc) Keep(l Locality, e *api.ServiceEntry) bool {
+	return f(l, e)
+}
+
+var (
+	registryMu sync.RWMutex
+	sorters    = make(map[string]Sorter)
+	filters    = make(map[string]Filter)
+)
+
+// RegisterSorter makes sorter available by name in the sort parameter.
+// It should be called before the target is parsed, e.g. in init function.
+// Sorter registered with the name of the existing one replaces it.
+func RegisterSorter(name string, s Sorter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	sorters[name] = s
+}
+
+// RegisterFilter makes filter available by name in the filter parameter.
+// It should be called before the target is parsed, e.g. in init function.
+// Filter registered with the name of the existing one replaces it.
+func RegisterFilter(name string, f Filter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	filters[name] = f
+}
+
+func getSorter(name string) (Sorter, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	s, ok := sorters[name]
+	return s, ok
+}
+
+func getFilter(name string) (Filter, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	f, ok := filters[name]
+	return f, ok
+}
+
+func init() {
+	RegisterSorter(sortNone, SorterFunc(func(Locality, []*api.ServiceEntry) {}))
+
+	RegisterSorter(sortByName, SorterFunc(func(_ Locality, entries []*api.ServiceEntry) {
+		sort.Sort(byName(entries))
+	}))
+
+	RegisterSorter(sortSameNodeFirst, SorterFunc(func(l Locality, entries []*api.ServiceEntry) {
+		sort.Sort(sameNodeFirst{
+			agentNodeName: l.Node,
+			in:            entries,
+		})
+	}))
+
+	RegisterSorter(sortSameZoneFirst, SorterFunc(func(l Locality, entries []*api.ServiceEntry) {
+		sort.Sort(byName(entries))
+		sort.Stable(sameZoneFirst{
+			zoneKey: l.ZoneKey,
+			zone:    l.Zone,
+			in:      entries,
+		})
+	}))
+
+	RegisterSorter(sortRTT, SorterFunc(func(l Locality, entries []*api.ServiceEntry) {
+		s := byRTT{
+			in:    entries,
+			rtt:   make([]time.Duration, len(entries)),
+			known: make([]bool, len(entries)),
+		}
+
+		for i, e := range entries {
+			if e.Node != nil {
+				s.rtt[i], s.known[i] = l.RTT(e.Node.Node)
+			}
+		}
+
+		sort.Stable(s)
+	}))
+}
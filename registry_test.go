@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegisterSorter("byPortDesc", SorterFunc(func(_ Locality, entries []*api.ServiceEntry) {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Service.Port > entries[j].Service.Port
+		})
+	}))
+
+	RegisterFilter("sameZoneOnly", FilterFunc(func(l Locality, e *api.ServiceEntry) bool {
+		return e.Node.Meta[l.ZoneKey] == l.Zone
+	}))
+}
+
+func TestRegistry_ParseTarget(t *testing.T) {
+	t.Parallel()
+
+	tgt, err := ParseTarget("consul://127.0.0.1:8500/svc?sort=byPortDesc&filter=sameZoneOnly")
+	require.NoError(t, err)
+	require.Equal(t, "byPortDesc", tgt.Sort)
+	require.Equal(t, []string{"sameZoneOnly"}, tgt.filters)
+
+	_, err = ParseTarget("consul://127.0.0.1:8500/svc?filter=sameZoneOnly,unknown")
+
+	var paramErr *ParamError
+	require.ErrorAs(t, err, &paramErr)
+	require.Equal(t, "filter", paramErr.Param)
+}
+
+func TestResolver_WatchConsulServiceCustomSorterAndFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		Near: "_agent",
+	}).Return([]*api.ServiceEntry{
+		{Node: &api.Node{Node: "n1", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+		{Node: &api.Node{Node: "n2", Meta: map[string]string{"zone": "b"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 2}},
+		{Node: &api.Node{Node: "n3", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 3}},
+	}, &api.QueryMeta{LastIndex: 1}, nil)
+
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		WaitIndex: 1,
+		Near:      "_agent",
+	}).DoAndReturn(func(
+		_ string,
+		_ []string,
+		_ bool,
+		opt *api.QueryOptions,
+	) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		select {}
+	}).MaxTimes(1)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Near:    "_agent",
+			Sort:    "byPortDesc",
+			filters: []string{"sameZoneOnly"},
+		},
+		zone: "a",
+		c:    mockConsul,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	select {
+	case got := <-s.WatchServiceChanges(ctx):
+		require.Equal(t, []*api.ServiceEntry{
+			{Node: &api.Node{Node: "n3", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 3}},
+			{Node: &api.Node{Node: "n1", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+		}, got)
+	case <-time.After(time.Second):
+		t.Fatal("endpoints haven't been fetched")
+	}
+}
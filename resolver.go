@@ -3,54 +3,92 @@ package consul
 import (
 	"context"
 	"fmt"
-	"sort"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/hashicorp/consul/api"
 )
 
+// zoneEnv is the environment variable holding the zone of the client.
+const zoneEnv = "GRPC_CONSUL_RESOLVER_ZONE"
+
 // Resolver is used to fetch service addressed from consul and watch for any changes.
 // For compatibility reasons it optionally supports grpc logging via WithLoggerV2 option.
 type Resolver struct {
-	logger Logger
+	logger  Logger
+	metrics Metrics
+	onError func(error)
+
+	t        *Target
+	zone     string
+	clientID string
+	client   *api.Client
+	c        consul
+	cat      catalog
+	agent    agent
+	rtt      *rttEstimator
 
-	t             *target
-	c             consul
-	agentNodeName string
+	// tokenProvider overrides the token of the target if set.
+	tokenProvider TokenProvider
+
+	mu              sync.Mutex
+	agentNodeName   string
+	trustDomainName string
+	state           map[string]ServiceState
 }
 
 func NewResolver(dsn string, opts ...Option) (*Resolver, error) {
-	t, err := newTarget(dsn)
+	t, err := ParseTarget(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	consulClient, err := api.NewClient(t.consulConfig())
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the Consul API: %w", err)
-	}
-
-	agentNodeName, err := consulClient.Agent().NodeName()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get agent node name: %w", err)
-	}
+	hostname, _ := os.Hostname()
 
 	r := &Resolver{
-		t:             t,
-		c:             consulClient.Health(),
-		agentNodeName: agentNodeName,
-		logger:        noopLogger{},
+		t:        &t,
+		zone:     os.Getenv(zoneEnv),
+		clientID: hostname,
+		logger:   noopLogger{},
+		metrics:  noopMetrics{},
+		onError:  func(error) {},
 	}
 
 	for _, o := range opts {
 		o(r)
 	}
 
+	if r.client == nil {
+		cfg := t.consulConfig()
+		if r.tokenProvider != nil {
+			cfg = withTokenProvider(cfg, r.tokenProvider)
+		}
+
+		r.client, err = api.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the Consul API: %w", err)
+		}
+	}
+
+	if t.Subset > 0 && r.clientID == "" {
+		r.logger.Errorf("[Consul resolver] Client ID is unknown, all the clients share the same subset. target={%s}", t.String())
+	}
+
+	if t.Sort == sortSameZoneFirst && r.zone == "" {
+		r.logger.Errorf("[Consul resolver] Zone of the client is unknown, endpoints are sorted by name. target={%s}", t.String())
+	}
+
+	r.c = r.client.Health()
+	r.cat = r.client.Catalog()
+	r.agent = r.client.Agent()
+	r.rtt = &rttEstimator{src: r.client.Coordinate(), dc: t.Dc}
+
 	return r, nil
 }
 
-//go:generate mockgen -source=resolver.go -package=consul -mock_names=consul=MockConsul -destination=consul_mock_test.go
+//go:generate mockgen -source=resolver.go -package=consul -mock_names=consul=MockConsul,catalog=MockCatalog,agent=MockAgent,coordinates=MockCoordinates -destination=consul_mock_test.go
 
 // consul is introduced for tests only.
 type consul interface {
@@ -60,82 +98,178 @@ type consul interface {
 		passingOnly bool,
 		q *api.QueryOptions,
 	) ([]*api.ServiceEntry, *api.QueryMeta, error)
+	ConnectMultipleTags(
+		service string,
+		tags []string,
+		passingOnly bool,
+		q *api.QueryOptions,
+	) ([]*api.ServiceEntry, *api.QueryMeta, error)
+}
+
+// catalog is introduced for tests only.
+type catalog interface {
+	ServiceMultipleTags(
+		service string,
+		tags []string,
+		q *api.QueryOptions,
+	) ([]*api.CatalogService, *api.QueryMeta, error)
+	ConnectMultipleTags(
+		service string,
+		tags []string,
+		q *api.QueryOptions,
+	) ([]*api.CatalogService, *api.QueryMeta, error)
+}
+
+// agent is introduced for tests only.
+type agent interface {
+	NodeName() (string, error)
+	ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error)
+	ConnectCALeaf(serviceID string, q *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error)
+	ConnectAuthorize(auth *api.AgentAuthorizeParams) (*api.AgentAuthorize, error)
+	Services() (map[string]*api.AgentService, error)
+	ServiceRegister(service *api.AgentServiceRegistration) error
+	ServiceDeregister(serviceID string) error
+	UpdateTTL(checkID, output, status string) error
+}
+
+// coordinates is introduced for tests only.
+type coordinates interface {
+	Node(node string, q *api.QueryOptions) ([]*api.CoordinateEntry, *api.QueryMeta, error)
 }
 
 // WatchServiceChanges will send service addresses into the
 // returned channel until passed context is cancelled.
+// Bursts of changes are batched if the target has coalesce window.
 func (r *Resolver) WatchServiceChanges(ctx context.Context) <-chan []*api.ServiceEntry {
+	out := r.watch(ctx)
+	if r.t.Coalesce > 0 {
+		return coalesce(ctx, out, r.t.Coalesce, r.t.CoalesceMax)
+	}
+
+	return out
+}
+
+// WatchEndpoints sends the endpoints handed to gRPC into the returned
+// channel until passed context is cancelled. Disappeared endpoints are retained
+// for the removal grace period if the target has one.
+func (r *Resolver) WatchEndpoints(ctx context.Context) <-chan []Endpoint {
+	in := r.WatchServiceChanges(ctx)
+	out := make(chan []Endpoint, 1)
+
+	go func() {
+		defer close(out)
+
+		for entries := range in {
+			select {
+			case out <- r.newEndpoints(entries):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if r.t.RemovalGrace > 0 {
+		return retain(ctx, out, r.t.RemovalGrace, r.t.RemovalGraceMax)
+	}
+
+	return out
+}
+
+// watch sends every change of the service addresses into the returned channel.
+// Every service of the target is watched by its own blocking loop.
+func (r *Resolver) watch(ctx context.Context) <-chan []*api.ServiceEntry {
 	out := make(chan []*api.ServiceEntry, 1)
 
 	go func() {
 		defer close(out)
 
-		bck := &backoff.ExponentialBackOff{
-			InitialInterval:     10 * time.Millisecond,
-			RandomizationFactor: backoff.DefaultRandomizationFactor,
-			Multiplier:          2,
-			MaxInterval:         r.t.MaxBackoff,
-			MaxElapsedTime:      backoff.DefaultMaxElapsedTime,
-			Stop:                backoff.Stop,
-			Clock:               backoff.SystemClock,
+		var agentNodeName string
+		if r.needsAgent() {
+			var ok bool
+			if agentNodeName, ok = r.discoverAgent(ctx, r.newBackoff()); !ok {
+				return
+			}
+		}
+
+		if r.t.Connect && !r.discoverTrustDomain(ctx, r.newBackoff()) {
+			return
 		}
 
-		var lastIndex uint64
+		services := r.t.serviceList()
+		updates := make(chan serviceUpdate)
+		for _, s := range services {
+			go r.watchService(ctx, s.Name, updates)
+		}
+
+		// estimates change without changes of the services,
+		// so the endpoints are re-sorted on every refresh
+		var refreshRTT <-chan time.Time
+		if r.t.Sort == sortRTT {
+			ticker := time.NewTicker(r.rtt.interval())
+			defer ticker.Stop()
+
+			refreshRTT = ticker.C
+		}
+
+		var (
+			latest    = make(map[string][]*api.ServiceEntry, len(services))
+			panicking = make(map[string]bool, len(services))
+			nonEmpty  bool
+		)
+
 		for {
-			endpoints, meta, err := r.c.ServiceMultipleTags(
-				r.t.Service,
-				r.t.tags,
-				r.t.Healthy,
-				&api.QueryOptions{
-					WaitIndex:         lastIndex,
-					Near:              r.t.Near,
-					WaitTime:          r.t.Wait,
-					Datacenter:        r.t.Dc,
-					AllowStale:        r.t.AllowStale,
-					RequireConsistent: r.t.RequireConsistent,
-				},
-			)
-			if err != nil {
-				r.logger.Errorf("[Consul resolver] Couldn't fetch endpoints. target={%s}; error={%v}", r.t.String(), err)
-				time.Sleep(bck.NextBackOff())
-				continue
-			}
+			// coordinates of new nodes are fetched on updates,
+			// all of them are refetched on the refresh
+			var refreshAll bool
+
+			select {
+			case u := <-updates:
+				entries, panicked := r.filter(u.service, u.entries)
+				if r.clientSideHealth() {
+					if panicked != panicking[u.service] {
+						r.logger.Errorf("[Consul resolver] Panic mode of '%s' changed to %t, healthy endpoints are below %d%%. target={%s}",
+							u.service,
+							panicked,
+							r.t.PanicThreshold,
+							r.t.String(),
+						)
+					}
 
-			bck.Reset()
+					panicking[u.service] = panicked
+					r.metrics.SetGauge(metricPanicMode, boolGauge(anyTrue(panicking)))
+				}
 
-			if meta.LastIndex == lastIndex {
-				continue
+				latest[u.service] = entries
+			case <-refreshRTT:
+				refreshAll = true
+			case <-ctx.Done():
+				return
 			}
 
-			if meta.LastIndex < lastIndex {
-				// according to https://www.consul.io/api-docs/features/blocking
-				// we should reset the index if it goes backward
-				lastIndex = 0
-			} else {
-				lastIndex = meta.LastIndex
+			// partial lists aren't published, so the first update has
+			// the endpoints of all the services the same way as Lookup
+			if len(latest) < len(services) {
+				continue
 			}
 
-			r.logger.Infof("[Consul resolver] %d endpoints fetched in(+wait) %s for target={%s}",
-				len(endpoints),
-				meta.RequestTime,
-				r.t.String(),
-			)
-
-			if r.t.Sort == sortSameNodeFirst {
-				sort.Sort(sameNodeFirst{
-					agentNodeName: r.agentNodeName,
-					in:            endpoints,
-				})
+			var endpoints []*api.ServiceEntry
+			for _, s := range services {
+				endpoints = append(endpoints, latest[s.Name]...)
 			}
 
-			if r.t.Sort == "" || r.t.Sort == sortByName {
-				sort.Sort(byName(endpoints))
+			if r.t.Sort == sortRTT {
+				r.refreshRTT(ctx, endpoints, refreshAll)
 			}
 
-			if r.t.Limit != 0 && len(endpoints) > r.t.Limit {
-				endpoints = endpoints[:r.t.Limit]
+			endpoints = r.arrange(endpoints, agentNodeName)
+			if len(endpoints) == 0 && nonEmpty && r.t.KeepNonEmpty {
+				r.logger.Errorf("[Consul resolver] No endpoints left, keeping the previous ones. target={%s}", r.t.String())
+				r.metrics.IncrCounter(metricEmptyUpdateIgnored, 1)
+				continue
 			}
 
+			nonEmpty = nonEmpty || len(endpoints) > 0
+
 			select {
 			case out <- endpoints:
 			case <-ctx.Done():
@@ -146,3 +280,365 @@ func (r *Resolver) WatchServiceChanges(ctx context.Context) <-chan []*api.Servic
 
 	return out
 }
+
+// serviceUpdate is the fresh list of the single service endpoints.
+type serviceUpdate struct {
+	service string
+	entries []*api.ServiceEntry
+}
+
+// watchService sends every change of the service endpoints into out until passed context is cancelled.
+func (r *Resolver) watchService(ctx context.Context, service string, out chan<- serviceUpdate) {
+	bck := r.newBackoff()
+
+	var lastIndex uint64
+	for {
+		endpoints, meta, err := r.fetch(service, r.queryOptions(lastIndex))
+		if err != nil {
+			r.logger.Errorf("[Consul resolver] Couldn't fetch endpoints of '%s'. target={%s}; error={%v}", service, r.t.String(), err)
+			r.onError(fmt.Errorf("failed to fetch endpoints of '%s': %w", service, err))
+
+			select {
+			case <-time.After(bck.NextBackOff()):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		bck.Reset()
+
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+
+		if meta.LastIndex < lastIndex {
+			// according to https://www.consul.io/api-docs/features/blocking
+			// we should reset the index if it goes backward
+			lastIndex = 0
+		} else {
+			lastIndex = meta.LastIndex
+		}
+
+		r.logger.Infof("[Consul resolver] %d endpoints of '%s' fetched in(+wait) %s for target={%s}",
+			len(endpoints),
+			service,
+			meta.RequestTime,
+			r.t.String(),
+		)
+
+		select {
+		case out <- serviceUpdate{service: service, entries: endpoints}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newBackoff returns backoff which never stops retrying.
+func (r *Resolver) newBackoff() backoff.BackOff {
+	return newBackoff(r.t.MaxBackoff)
+}
+
+// Lookup returns current service endpoints. Endpoints are
+// filtered, sorted and limited the same way as in WatchServiceChanges.
+func (r *Resolver) Lookup(ctx context.Context) ([]Endpoint, error) {
+	var (
+		agentNodeName string
+		err           error
+	)
+
+	if r.needsAgent() {
+		agentNodeName, err = r.agentNode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get agent node name: %w", err)
+		}
+	}
+
+	if r.t.Connect {
+		if _, err = r.trustDomain(); err != nil {
+			return nil, fmt.Errorf("failed to get Connect trust domain: %w", err)
+		}
+	}
+
+	var endpoints []*api.ServiceEntry
+	for _, s := range r.t.serviceList() {
+		entries, _, err := r.fetch(s.Name, r.queryOptions(0).WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch endpoints of '%s': %w", s.Name, err)
+		}
+
+		entries, _ = r.filter(s.Name, entries)
+		endpoints = append(endpoints, entries...)
+	}
+
+	if r.t.Sort == sortRTT {
+		r.refreshRTT(ctx, endpoints, false)
+	}
+
+	return r.newEndpoints(r.arrange(endpoints, agentNodeName)), nil
+}
+
+// Lookup is a shortcut for the one-shot resolving of the passed dsn.
+func Lookup(ctx context.Context, dsn string, opts ...Option) ([]Endpoint, error) {
+	r, err := NewResolver(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Lookup(ctx)
+}
+
+// queryOptions returns options of the query for
+// service endpoints blocked until passed index changes.
+func (r *Resolver) queryOptions(waitIndex uint64) *api.QueryOptions {
+	return &api.QueryOptions{
+		WaitIndex:         waitIndex,
+		Near:              r.t.Near,
+		WaitTime:          r.t.Wait,
+		Datacenter:        r.t.Dc,
+		AllowStale:        r.t.AllowStale,
+		RequireConsistent: r.t.RequireConsistent,
+	}
+}
+
+// fetch queries Consul for the service endpoints. Sidecar proxies
+// and Connect-native instances are returned for connect=true.
+// Catalog instances are converted to the health form for source=catalog.
+func (r *Resolver) fetch(service string, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	// all the endpoints are fetched, health is checked by filter
+	const passingOnly = false
+
+	var (
+		entries []*api.ServiceEntry
+		meta    *api.QueryMeta
+		err     error
+	)
+
+	switch {
+	case r.t.Source == sourceCatalog:
+		entries, meta, err = r.fetchCatalog(service, q)
+	case r.t.Connect:
+		entries, meta, err = r.c.ConnectMultipleTags(service, r.t.tags, passingOnly, q)
+	default:
+		entries, meta, err = r.c.ServiceMultipleTags(service, r.t.tags, passingOnly, q)
+	}
+
+	if err == nil {
+		r.recordFetch(service, len(entries), meta)
+	}
+
+	return entries, meta, err
+}
+
+// clientSideHealth reports whether health of the endpoints is checked by
+// the resolver. It's the case for any health mode but 'any': with passingOnly
+// Consul silently drops the endpoints in maintenance mode, so they couldn't
+// be reported, and it can't decide on the panic mode or ignore checks.
+func (r *Resolver) clientSideHealth() bool {
+	return r.t.healthMode() != healthAny
+}
+
+// filter drops endpoints without valid port, endpoints in maintenance
+// mode and unhealthy endpoints unless any health is accepted.
+// It returns true if the resolver is in the panic mode.
+func (r *Resolver) filter(service string, endpoints []*api.ServiceEntry) ([]*api.ServiceEntry, bool) {
+	endpoints = r.selectPorts(endpoints)
+	if !r.t.IncludeMaintenance {
+		endpoints = r.excludeMaintenance(service, endpoints)
+	}
+
+	if !r.clientSideHealth() {
+		return endpoints, false
+	}
+
+	return selectHealthy(endpoints, r.t.healthPolicy(), r.t.PanicThreshold)
+}
+
+// arrange filters fetched endpoints, selects the subset,
+// sorts selected endpoints and applies the limit.
+func (r *Resolver) arrange(endpoints []*api.ServiceEntry, agentNodeName string) []*api.ServiceEntry {
+	l := r.locality(agentNodeName)
+
+	for _, name := range r.t.filters {
+		f, ok := getFilter(name)
+		if !ok {
+			r.logger.Errorf("[Consul resolver] Unknown filter '%s' is skipped. target={%s}", name, r.t.String())
+			continue
+		}
+
+		kept := endpoints[:0]
+		for _, e := range endpoints {
+			if f.Keep(l, e) {
+				kept = append(kept, e)
+			}
+		}
+
+		endpoints = kept
+	}
+
+	if r.t.Subset > 0 {
+		endpoints = subset(r.clientID, endpoints, r.t.Subset)
+	}
+
+	name := r.t.Sort
+	if name == "" {
+		name = sortByName
+	}
+
+	if s, ok := getSorter(name); ok {
+		s.Sort(l, endpoints)
+	} else {
+		r.logger.Errorf("[Consul resolver] Unknown sorter '%s', endpoints aren't sorted. target={%s}", name, r.t.String())
+	}
+
+	if r.t.Limit != 0 && len(endpoints) > r.t.Limit {
+		endpoints = endpoints[:r.t.Limit]
+	}
+
+	return endpoints
+}
+
+// locality returns the client description for sorters and filters.
+func (r *Resolver) locality(agentNodeName string) Locality {
+	return Locality{
+		Node:    agentNodeName,
+		Zone:    r.zone,
+		ZoneKey: r.t.zoneKey(),
+		RTT: func(node string) (time.Duration, bool) {
+			return r.rtt.rtt(r.rttOrigin(), node)
+		},
+	}
+}
+
+// refreshRTT fetches network coordinates of the origin and the nodes of the
+// endpoints, all of them or only expired ones. Failures are only logged,
+// endpoints with unknown estimates are sorted last.
+func (r *Resolver) refreshRTT(ctx context.Context, endpoints []*api.ServiceEntry, all bool) {
+	maxAge := r.rtt.interval()
+	if all {
+		maxAge = 0
+	}
+
+	nodes := make([]string, 0, len(endpoints)+1)
+	nodes = append(nodes, r.rttOrigin())
+	for _, e := range endpoints {
+		if e.Node != nil {
+			nodes = append(nodes, e.Node.Node)
+		}
+	}
+
+	if err := r.rtt.refresh(ctx, time.Now(), nodes, maxAge); err != nil {
+		r.logger.Errorf("[Consul resolver] Couldn't fetch network coordinates. target={%s}; error={%v}", r.t.String(), err)
+	}
+}
+
+// needsAgent reports whether the name of the agent node is needed for sorting.
+func (r *Resolver) needsAgent() bool {
+	return r.t.Sort == sortSameNodeFirst || (r.t.Sort == sortRTT && r.t.Near == defaultNear)
+}
+
+// rttOrigin returns the node which round trip time is estimated from.
+func (r *Resolver) rttOrigin() string {
+	if r.t.Near != defaultNear {
+		return r.t.Near
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.agentNodeName
+}
+
+// newEndpoints converts entries into endpoints with weights of their
+// services, expected identities for connect=true and round trip
+// time estimates for sort=rtt.
+func (r *Resolver) newEndpoints(entries []*api.ServiceEntry) []Endpoint {
+	endpoints := newEndpoints(entries)
+
+	if r.t.Port != 0 || r.t.PortMeta != "" || r.t.Connect {
+		for i, e := range endpoints {
+			host := e.Entry.Service.Address
+			if host == "" && r.t.Connect && e.Entry.Node != nil {
+				// sidecar proxies are often registered without address
+				host = e.Entry.Node.Address
+			}
+
+			port, _ := r.t.port(e.Entry)
+			endpoints[i].Addr = fmt.Sprintf("%s:%d", host, port)
+		}
+	}
+
+	if r.t.Connect {
+		r.mu.Lock()
+		trustDomain := r.trustDomainName
+		r.mu.Unlock()
+
+		for i, e := range endpoints {
+			endpoints[i].Identity = spiffeID(trustDomain, e.Entry)
+		}
+	}
+
+	if services := r.t.serviceList(); len(services) > 1 {
+		weights := make(map[string]int, len(services))
+		for _, s := range services {
+			weights[s.Name] = s.Weight
+		}
+
+		for i, e := range endpoints {
+			endpoints[i].Weight = weights[serviceName(e.Entry)]
+		}
+	}
+
+	if r.t.Sort == sortRTT {
+		origin := r.rttOrigin()
+		for i, e := range endpoints {
+			if e.Entry.Node != nil {
+				endpoints[i].RTT, endpoints[i].rttKnown = r.rtt.rtt(origin, e.Entry.Node.Node)
+			}
+		}
+	}
+
+	return endpoints
+}
+
+// agentNode returns the name of the agent node. It's cached after the first success.
+func (r *Resolver) agentNode() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.agentNodeName != "" {
+		return r.agentNodeName, nil
+	}
+
+	name, err := r.agent.NodeName()
+	if err != nil {
+		return "", err
+	}
+
+	r.agentNodeName = name
+
+	return name, nil
+}
+
+// discoverAgent fetches the name of the agent node retrying with backoff.
+// It returns false if passed context is cancelled before the name is known.
+func (r *Resolver) discoverAgent(ctx context.Context, bck backoff.BackOff) (string, bool) {
+	defer bck.Reset()
+
+	for {
+		name, err := r.agentNode()
+		if err == nil {
+			return name, true
+		}
+
+		r.logger.Errorf("[Consul resolver] Couldn't get agent node name. target={%s}; error={%v}", r.t.String(), err)
+		r.onError(fmt.Errorf("failed to get agent node name: %w", err))
+
+		select {
+		case <-time.After(bck.NextBackOff()):
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+}
@@ -3,6 +3,8 @@ package consul
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,20 +16,20 @@ import (
 func TestResolver_WatchConsulService(t *testing.T) {
 	tt := []struct {
 		name   string
-		target *target
+		target *Target
 		setup  func(m *MockConsul)
 		expect []*api.ServiceEntry
 	}{
 		{
 			name: "ok no limit",
-			target: &target{
+			target: &Target{
 				Service: "svc",
 				Wait:    time.Second,
 				Healthy: true,
 				Near:    "_agent",
 			},
 			setup: func(m *MockConsul) {
-				m.EXPECT().ServiceMultipleTags("svc", nil, true, &api.QueryOptions{
+				m.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
 					Near:     "_agent",
 					WaitTime: time.Second,
 				}).Return([]*api.ServiceEntry{
@@ -36,7 +38,7 @@ func TestResolver_WatchConsulService(t *testing.T) {
 					},
 				}, &api.QueryMeta{LastIndex: 1}, nil)
 
-				m.EXPECT().ServiceMultipleTags("svc", nil, true, &api.QueryOptions{
+				m.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
 					WaitIndex: 1,
 					Near:      "_agent",
 					WaitTime:  time.Second,
@@ -57,7 +59,7 @@ func TestResolver_WatchConsulService(t *testing.T) {
 		},
 		{
 			name: "ok limit sort same node first",
-			target: &target{
+			target: &Target{
 				Service: "svc",
 				Wait:    time.Second,
 				Near:    "_agent",
@@ -94,9 +96,45 @@ func TestResolver_WatchConsulService(t *testing.T) {
 				{Node: &api.Node{Node: "myNode"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 8080}},
 			},
 		},
+		{
+			name: "ok limit sort same zone first",
+			target: &Target{
+				Service: "svc",
+				Near:    "_agent",
+				Limit:   3,
+				Sort:    sortSameZoneFirst,
+			},
+			setup: func(m *MockConsul) {
+				m.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+					Near: "_agent",
+				}).Return([]*api.ServiceEntry{
+					{Node: &api.Node{Node: "n1", Meta: map[string]string{"zone": "b"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+					{Node: &api.Node{Node: "n2", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.4", Port: 1}},
+					{Node: &api.Node{Node: "n3", Meta: map[string]string{"zone": "c"}}, Service: &api.AgentService{Address: "127.0.0.3", Port: 1}},
+					{Node: &api.Node{Node: "n4", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.2", Port: 1}},
+				}, &api.QueryMeta{LastIndex: 1}, nil)
+
+				m.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+					WaitIndex: 1,
+					Near:      "_agent",
+				}).DoAndReturn(func(
+					_ string,
+					_ []string,
+					_ bool,
+					opt *api.QueryOptions,
+				) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+					select {}
+				})
+			},
+			expect: []*api.ServiceEntry{
+				{Node: &api.Node{Node: "n4", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.2", Port: 1}},
+				{Node: &api.Node{Node: "n2", Meta: map[string]string{"zone": "a"}}, Service: &api.AgentService{Address: "127.0.0.4", Port: 1}},
+				{Node: &api.Node{Node: "n1", Meta: map[string]string{"zone": "b"}}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+			},
+		},
 		{
 			name: "consul error",
-			target: &target{
+			target: &Target{
 				Service: "svc",
 				Wait:    time.Second,
 				Near:    "_agent",
@@ -140,7 +178,7 @@ func TestResolver_WatchConsulService(t *testing.T) {
 		},
 		{
 			name: "no change",
-			target: &target{
+			target: &Target{
 				Service: "svc",
 				Wait:    time.Second,
 				Near:    "_agent",
@@ -191,7 +229,10 @@ func TestResolver_WatchConsulService(t *testing.T) {
 
 			s := &Resolver{
 				logger:        noopLogger{},
+				metrics:       noopMetrics{},
+				onError:       func(error) {},
 				t:             tc.target,
+				zone:          "a",
 				c:             mockConsul,
 				agentNodeName: "myNode",
 			}
@@ -211,3 +252,334 @@ func TestResolver_WatchConsulService(t *testing.T) {
 		})
 	}
 }
+
+func TestResolver_WatchConsulServiceAgentDiscovery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockAgent := NewMockAgent(ctrl)
+	gomock.InOrder(
+		mockAgent.EXPECT().NodeName().Return("", fmt.Errorf("some error")),
+		mockAgent.EXPECT().NodeName().Return("myNode", nil),
+	)
+
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		Near: "_agent",
+	}).Return([]*api.ServiceEntry{
+		{Node: &api.Node{Node: "myNode2"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1024}},
+		{Node: &api.Node{Node: "myNode"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 8080}},
+	}, &api.QueryMeta{LastIndex: 1}, nil)
+
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		WaitIndex: 1,
+		Near:      "_agent",
+	}).DoAndReturn(func(
+		_ string,
+		_ []string,
+		_ bool,
+		opt *api.QueryOptions,
+	) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		select {}
+	})
+
+	var reported []error
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(err error) { reported = append(reported, err) },
+		t: &Target{
+			Service:    "svc",
+			Near:       "_agent",
+			MaxBackoff: time.Millisecond,
+			Limit:      1,
+			Sort:       sortSameNodeFirst,
+		},
+		c:     mockConsul,
+		agent: mockAgent,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("endpoints haven't been fetched")
+	case got := <-s.WatchServiceChanges(ctx):
+		require.Equal(t, []*api.ServiceEntry{
+			{Node: &api.Node{Node: "myNode"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 8080}},
+		}, got)
+	}
+
+	require.Len(t, reported, 1)
+	require.EqualError(t, reported[0], "failed to get agent node name: some error")
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ServiceMultipleTags("svc", []string{"green"}, false, gomock.Any()).DoAndReturn(func(
+		_ string,
+		_ []string,
+		_ bool,
+		opt *api.QueryOptions,
+	) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		require.Equal(t, ctx, opt.Context())
+		require.Equal(t, uint64(0), opt.WaitIndex)
+		require.Equal(t, "dc1", opt.Datacenter)
+
+		return []*api.ServiceEntry{
+			{Node: &api.Node{Node: "myNode2"}, Service: &api.AgentService{Address: "127.0.0.2", Port: 1024}},
+			{Node: &api.Node{Node: "myNode"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 8080}},
+			{Node: &api.Node{Node: "myNode2"}, Service: &api.AgentService{Address: "127.0.0.3", Port: 1025}},
+		}, &api.QueryMeta{LastIndex: 10}, nil
+	})
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Dc:      "dc1",
+			Near:    "_agent",
+			Healthy: true,
+			tags:    []string{"green"},
+			Limit:   2,
+		},
+		c: mockConsul,
+	}
+
+	got, err := s.Lookup(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Endpoint{
+		{
+			Addr:  "127.0.0.1:8080",
+			Entry: &api.ServiceEntry{Node: &api.Node{Node: "myNode"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 8080}},
+		},
+		{
+			Addr:  "127.0.0.2:1024",
+			Entry: &api.ServiceEntry{Node: &api.Node{Node: "myNode2"}, Service: &api.AgentService{Address: "127.0.0.2", Port: 1024}},
+		},
+	}, got)
+}
+
+type metricsRecorder struct {
+	mu       sync.Mutex
+	counters map[string]float32
+	gauges   map[string]float32
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{
+		counters: make(map[string]float32),
+		gauges:   make(map[string]float32),
+	}
+}
+
+func (m *metricsRecorder) IncrCounter(key []string, val float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[strings.Join(key, ".")] += val
+}
+
+func (m *metricsRecorder) SetGauge(key []string, val float32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gauges[strings.Join(key, ".")] = val
+}
+
+func (m *metricsRecorder) counter(key []string) float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[strings.Join(key, ".")]
+}
+
+func (m *metricsRecorder) gauge(key []string) float32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.gauges[strings.Join(key, ".")]
+}
+
+func TestResolver_WatchConsulServicePanicMode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	proceed := make(chan struct{})
+	passing := api.HealthChecks{{CheckID: "serfHealth", Status: api.HealthPassing}}
+	critical := api.HealthChecks{{CheckID: "serfHealth", Status: api.HealthCritical}}
+
+	mockConsul := NewMockConsul(ctrl)
+	gomock.InOrder(
+		// passingOnly is disabled to see all the instances
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			Near: "_agent",
+		}).Return([]*api.ServiceEntry{
+			{Service: &api.AgentService{Address: "127.0.0.1", Port: 1}, Checks: passing},
+			{Service: &api.AgentService{Address: "127.0.0.2", Port: 1}, Checks: critical},
+			{Service: &api.AgentService{Address: "127.0.0.3", Port: 1}, Checks: critical},
+		}, &api.QueryMeta{LastIndex: 1}, nil),
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 1,
+			Near:      "_agent",
+		}).DoAndReturn(func(
+			_ string,
+			_ []string,
+			_ bool,
+			opt *api.QueryOptions,
+		) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			<-proceed
+			return []*api.ServiceEntry{
+				{Service: &api.AgentService{Address: "127.0.0.1", Port: 1}, Checks: passing},
+				{Service: &api.AgentService{Address: "127.0.0.2", Port: 1}, Checks: passing},
+				{Service: &api.AgentService{Address: "127.0.0.3", Port: 1}, Checks: critical},
+			}, &api.QueryMeta{LastIndex: 2}, nil
+		}),
+		// empty list is ignored
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 2,
+			Near:      "_agent",
+		}).DoAndReturn(func(
+			_ string,
+			_ []string,
+			_ bool,
+			opt *api.QueryOptions,
+		) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			<-proceed
+			return nil, &api.QueryMeta{LastIndex: 3}, nil
+		}),
+		mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+			WaitIndex: 3,
+			Near:      "_agent",
+		}).DoAndReturn(func(
+			_ string,
+			_ []string,
+			_ bool,
+			opt *api.QueryOptions,
+		) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+			select {}
+		}),
+	)
+
+	metrics := newMetricsRecorder()
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: metrics,
+		onError: func(error) {},
+		t: &Target{
+			Service:        "svc",
+			Near:           "_agent",
+			Healthy:        true,
+			PanicThreshold: 50,
+			KeepNonEmpty:   true,
+		},
+		c: mockConsul,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	out := s.WatchServiceChanges(ctx)
+
+	got := <-out
+	require.Len(t, got, 3)
+	require.Equal(t, float32(1), metrics.gauge(metricPanicMode))
+	proceed <- struct{}{}
+
+	got = <-out
+	require.Equal(t, []*api.ServiceEntry{
+		{Service: &api.AgentService{Address: "127.0.0.1", Port: 1}, Checks: passing},
+		{Service: &api.AgentService{Address: "127.0.0.2", Port: 1}, Checks: passing},
+	}, got)
+	require.Equal(t, float32(0), metrics.gauge(metricPanicMode))
+	proceed <- struct{}{}
+
+	require.Eventually(t, func() bool {
+		return metrics.counter(metricEmptyUpdateIgnored) == 1
+	}, time.Second, time.Millisecond)
+
+	select {
+	case got := <-out:
+		t.Fatalf("unexpected update: %v", got)
+	default:
+	}
+}
+
+func TestResolver_WatchConsulServiceMultiple(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	v1 := &api.ServiceEntry{Service: &api.AgentService{Service: "payments-v1", Address: "127.0.0.2", Port: 1}}
+	v2 := &api.ServiceEntry{Service: &api.AgentService{Service: "payments-v2", Address: "127.0.0.1", Port: 1}}
+
+	block := func(string, []string, bool, *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		select {}
+	}
+
+	mockConsul := NewMockConsul(ctrl)
+	for i, e := range []*api.ServiceEntry{v1, v2} {
+		// payments-v2 answers later, so payments-v1 alone would be published first
+		delay := time.Duration(i) * 50 * time.Millisecond
+		entries := []*api.ServiceEntry{e}
+
+		gomock.InOrder(
+			mockConsul.EXPECT().ServiceMultipleTags(e.Service.Service, nil, false, &api.QueryOptions{Near: "_agent"}).
+				DoAndReturn(func(string, []string, bool, *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+					time.Sleep(delay)
+					return entries, &api.QueryMeta{LastIndex: 1}, nil
+				}),
+			mockConsul.EXPECT().ServiceMultipleTags(e.Service.Service, nil, false, &api.QueryOptions{WaitIndex: 1, Near: "_agent"}).
+				DoAndReturn(block).MaxTimes(1),
+		)
+	}
+
+	tgt, err := ParseTarget("consul://127.0.0.1:8500/payments-v1,payments-v2:3?sort=byName")
+	require.NoError(t, err)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t:       &tgt,
+		c:       mockConsul,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var got []Endpoint
+	select {
+	case got = <-s.WatchEndpoints(ctx):
+	case <-time.After(time.Second):
+		t.Fatal("endpoints haven't been fetched")
+	}
+
+	// the first update has the endpoints of all the services
+	require.Equal(t, []Endpoint{
+		{Addr: "127.0.0.1:1", Entry: v2, Weight: 3},
+		{Addr: "127.0.0.2:1", Entry: v1, Weight: 1},
+	}, got)
+
+	w, ok := Weight(got[0].address())
+	require.True(t, ok)
+	require.Equal(t, 3, w)
+}
+
+func TestResolver_NewBackoff(t *testing.T) {
+	t.Parallel()
+
+	r := &Resolver{t: &Target{MaxBackoff: time.Second}}
+
+	bck := r.newBackoff()
+	for i := 0; i < 20; i++ {
+		next := bck.NextBackOff()
+		require.Greater(t, next, time.Duration(0))
+		// randomization may exceed max backoff by a half
+		require.LessOrEqual(t, next, 3*time.Second/2)
+	}
+}
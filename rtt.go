@@ -0,0 +1,144 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+	"google.golang.org/grpc/resolver"
+)
+
+// coordinatesTTL is the period after which network coordinates are refetched.
+const coordinatesTTL = 30 * time.Second
+
+// rttEstimator estimates round trip time between nodes using network
+// coordinates cached for coordinatesTTL. Only the coordinates of the nodes
+// in use are fetched, one by one, instead of the whole datacenter.
+type rttEstimator struct {
+	src coordinates
+	dc  string
+	// ttl overrides coordinatesTTL in tests.
+	ttl time.Duration
+
+	mu     sync.Mutex
+	byNode map[string]nodeCoordinate
+}
+
+// nodeCoordinate is the cached coordinate of the node,
+// it's nil if the node has no coordinates yet.
+type nodeCoordinate struct {
+	coord   *coordinate.Coordinate
+	fetched time.Time
+}
+
+// interval returns the period of the coordinates refresh.
+func (e *rttEstimator) interval() time.Duration {
+	if e.ttl > 0 {
+		return e.ttl
+	}
+
+	return coordinatesTTL
+}
+
+// refresh fetches coordinates of the passed nodes cached longer than maxAge ago
+// or not cached at all. Coordinates of other nodes are dropped. Nodes which
+// failed to be fetched keep their previous coordinates and the first error is returned.
+func (e *rttEstimator) refresh(ctx context.Context, now time.Time, nodes []string, maxAge time.Duration) error {
+	e.mu.Lock()
+
+	inUse := make(map[string]bool, len(nodes))
+	stale := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node == "" || inUse[node] {
+			continue
+		}
+
+		inUse[node] = true
+		if c, ok := e.byNode[node]; !ok || now.Sub(c.fetched) >= maxAge {
+			stale = append(stale, node)
+		}
+	}
+
+	for node := range e.byNode {
+		if !inUse[node] {
+			delete(e.byNode, node)
+		}
+	}
+
+	e.mu.Unlock()
+
+	var firstErr error
+	for _, node := range stale {
+		coord, err := e.fetch(ctx, node)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to fetch coordinates of '%s': %w", node, err)
+			}
+
+			continue
+		}
+
+		e.mu.Lock()
+		if e.byNode == nil {
+			e.byNode = make(map[string]nodeCoordinate)
+		}
+
+		e.byNode[node] = nodeCoordinate{coord: coord, fetched: now}
+		e.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// fetch returns the coordinate of the node or nil if the node has no coordinates.
+func (e *rttEstimator) fetch(ctx context.Context, node string) (*coordinate.Coordinate, error) {
+	entries, _, err := e.src.Node(node, (&api.QueryOptions{Datacenter: e.dc}).WithContext(ctx))
+
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+		// new nodes don't have coordinates until they are calculated
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var coord *coordinate.Coordinate
+	for _, c := range entries {
+		// nodes in network segments have several coordinates,
+		// the one from the default segment is preferred
+		if coord == nil || c.Segment == "" {
+			coord = c.Coord
+		}
+	}
+
+	return coord, nil
+}
+
+// rtt returns estimated round trip time between the passed nodes.
+func (e *rttEstimator) rtt(from, to string) (time.Duration, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	a, b := e.byNode[from].coord, e.byNode[to].coord
+	if a == nil || b == nil || !a.IsCompatibleWith(b) {
+		return 0, false
+	}
+
+	return a.DistanceTo(b), true
+}
+
+type rttKey struct{}
+
+// RTT returns round trip time to the address estimated from Consul network
+// coordinates. It's known only for the addresses resolved with sort=rtt.
+func RTT(addr resolver.Address) (time.Duration, bool) {
+	rtt, ok := addr.BalancerAttributes.Value(rttKey{}).(time.Duration)
+	return rtt, ok
+}
@@ -0,0 +1,170 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+)
+
+// coord returns coordinate at the passed distance
+// in milliseconds from the origin along the first axis.
+func coord(ms float64) *coordinate.Coordinate {
+	c := coordinate.NewCoordinate(coordinate.DefaultConfig())
+	c.Height = 0
+	c.Vec[0] = ms / 1000
+
+	return c
+}
+
+func TestRTTEstimator(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	mockCoordinates := NewMockCoordinates(ctrl)
+
+	ctx := context.Background()
+	q := (&api.QueryOptions{Datacenter: "dc1"}).WithContext(ctx)
+	now := time.Unix(1000, 0)
+
+	mockCoordinates.EXPECT().Node("n1", q).Return([]*api.CoordinateEntry{{Node: "n1", Coord: coord(0)}}, &api.QueryMeta{}, nil)
+	gomock.InOrder(
+		mockCoordinates.EXPECT().Node("n2", q).Return([]*api.CoordinateEntry{
+			{Node: "n2", Segment: "alpha", Coord: coord(50)},
+			{Node: "n2", Coord: coord(20)},
+		}, &api.QueryMeta{}, nil),
+		mockCoordinates.EXPECT().Node("n2", q).Return(nil, nil, fmt.Errorf("some error")),
+	)
+	// the node without coordinates yet
+	mockCoordinates.EXPECT().Node("n3", q).Return(nil, nil, api.StatusError{Code: http.StatusNotFound}).Times(2)
+
+	e := &rttEstimator{src: mockCoordinates, dc: "dc1"}
+	require.NoError(t, e.refresh(ctx, now, []string{"n1", "n2", "n3", "n2", ""}, coordinatesTTL))
+
+	rtt, ok := e.rtt("n1", "n2")
+	require.True(t, ok)
+	require.Equal(t, 20*time.Millisecond, rtt)
+
+	_, ok = e.rtt("n1", "n3")
+	require.False(t, ok)
+
+	// cached
+	require.NoError(t, e.refresh(ctx, now.Add(coordinatesTTL-1), []string{"n1", "n2", "n3"}, coordinatesTTL))
+
+	// n1 is dropped as unused, n2 keeps previous coordinates on error
+	require.Error(t, e.refresh(ctx, now.Add(coordinatesTTL), []string{"n2", "n3"}, coordinatesTTL))
+
+	_, ok = e.rtt("n1", "n2")
+	require.False(t, ok)
+
+	e.mu.Lock()
+	require.NotNil(t, e.byNode["n2"].coord)
+	e.mu.Unlock()
+}
+
+func TestResolver_WatchConsulServiceSortRTT(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockCoordinates := NewMockCoordinates(ctrl)
+	coordinates := func(node string, ms float64) ([]*api.CoordinateEntry, *api.QueryMeta, error) {
+		return []*api.CoordinateEntry{{Node: node, Coord: coord(ms)}}, &api.QueryMeta{}, nil
+	}
+
+	// only the nodes in use are fetched
+	mockCoordinates.EXPECT().Node("myNode", gomock.Any()).Return(coordinates("myNode", 0)).MinTimes(1)
+	mockCoordinates.EXPECT().Node("n2", gomock.Any()).Return(coordinates("n2", 10)).MinTimes(1)
+	mockCoordinates.EXPECT().Node("n3", gomock.Any()).Return(nil, nil, api.StatusError{Code: http.StatusNotFound}).MinTimes(1)
+	gomock.InOrder(
+		mockCoordinates.EXPECT().Node("n1", gomock.Any()).Return(coordinates("n1", 30)),
+		// n1 gets closer than n2 without any change of the service
+		mockCoordinates.EXPECT().Node("n1", gomock.Any()).Return(coordinates("n1", 5)).MinTimes(1),
+	)
+
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		Near: "_agent",
+	}).Return([]*api.ServiceEntry{
+		{Node: &api.Node{Node: "n3"}, Service: &api.AgentService{Address: "127.0.0.3", Port: 1}},
+		{Node: &api.Node{Node: "n1"}, Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+		{Node: &api.Node{Node: "n2"}, Service: &api.AgentService{Address: "127.0.0.2", Port: 1}},
+	}, &api.QueryMeta{LastIndex: 1}, nil)
+
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, &api.QueryOptions{
+		WaitIndex: 1,
+		Near:      "_agent",
+	}).DoAndReturn(func(
+		_ string,
+		_ []string,
+		_ bool,
+		opt *api.QueryOptions,
+	) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+		select {}
+	}).MaxTimes(1)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Near:    "_agent",
+			Sort:    sortRTT,
+		},
+		c:             mockConsul,
+		rtt:           &rttEstimator{src: mockCoordinates, ttl: 10 * time.Millisecond},
+		agentNodeName: "myNode",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	addrs := func(endpoints []Endpoint) []string {
+		res := make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			res = append(res, e.Addr)
+		}
+
+		return res
+	}
+
+	ch := s.WatchEndpoints(ctx)
+
+	var got []Endpoint
+	select {
+	case got = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("endpoints haven't been fetched")
+	}
+
+	require.Equal(t, []string{"127.0.0.2:1", "127.0.0.1:1", "127.0.0.3:1"}, addrs(got))
+
+	rtt, ok := RTT(got[0].address())
+	require.True(t, ok)
+	require.Equal(t, 10*time.Millisecond, rtt)
+
+	_, ok = RTT(got[2].address())
+	require.False(t, ok)
+
+	_, ok = RTT(resolver.Address{Addr: "127.0.0.1:1"})
+	require.False(t, ok)
+
+	// refreshed coordinates are published re-sorted
+	select {
+	case got = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("endpoints haven't been re-sorted")
+	}
+
+	require.Equal(t, []string{"127.0.0.1:1", "127.0.0.2:1", "127.0.0.3:1"}, addrs(got))
+
+	rtt, ok = RTT(got[0].address())
+	require.True(t, ok)
+	require.Equal(t, 5*time.Millisecond, rtt)
+}
@@ -1,6 +1,8 @@
 package consul
 
 import (
+	"time"
+
 	"github.com/hashicorp/consul/api"
 )
 
@@ -8,6 +10,8 @@ const (
 	sortNone          = "none"
 	sortByName        = "byName"
 	sortSameNodeFirst = "sameNodeFirst"
+	sortSameZoneFirst = "sameZoneFirst"
+	sortRTT           = "rtt"
 )
 
 // sameNodeFirst sorts services so that services on the same
@@ -30,9 +34,55 @@ func (n sameNodeFirst) Less(i, j int) bool {
 	return false
 }
 
+// sameZoneFirst sorts services so that services in the same zone
+// go first, zone is taken from the node meta by the key. Being used
+// with sort.Stable it keeps the order of services within the zone.
+// Useful with limit to spill over to other zones only when the
+// local one doesn't have enough services.
+type sameZoneFirst struct {
+	zoneKey string
+	zone    string
+	in      []*api.ServiceEntry
+}
+
+func (z sameZoneFirst) Len() int      { return len(z.in) }
+func (z sameZoneFirst) Swap(i, j int) { z.in[i], z.in[j] = z.in[j], z.in[i] }
+
+func (z sameZoneFirst) Less(i, j int) bool {
+	return z.inZone(z.in[i]) && !z.inZone(z.in[j])
+}
+
+func (z sameZoneFirst) inZone(e *api.ServiceEntry) bool {
+	return z.zone != "" && e.Node != nil && e.Node.Meta[z.zoneKey] == z.zone
+}
+
 // byName sorts services by address lexicographic order.
 type byName []*api.ServiceEntry
 
 func (p byName) Len() int           { return len(p) }
 func (p byName) Less(i, j int) bool { return p[i].Service.Address < p[j].Service.Address }
 func (p byName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// byRTT sorts services by round trip time to their nodes. Being used
+// with sort.Stable it keeps services with unknown time in the end.
+type byRTT struct {
+	in    []*api.ServiceEntry
+	rtt   []time.Duration
+	known []bool
+}
+
+func (r byRTT) Len() int { return len(r.in) }
+
+func (r byRTT) Swap(i, j int) {
+	r.in[i], r.in[j] = r.in[j], r.in[i]
+	r.rtt[i], r.rtt[j] = r.rtt[j], r.rtt[i]
+	r.known[i], r.known[j] = r.known[j], r.known[i]
+}
+
+func (r byRTT) Less(i, j int) bool {
+	if r.known[i] != r.known[j] {
+		return r.known[i]
+	}
+
+	return r.rtt[i] < r.rtt[j]
+}
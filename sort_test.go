@@ -464,3 +464,75 @@ func TestSortByName(t *testing.T) {
 		})
 	}
 }
+
+func TestSortSameZoneFirst(t *testing.T) {
+	t.Parallel()
+
+	entry := func(zone, addr string) *api.ServiceEntry {
+		e := &api.ServiceEntry{
+			Node: &api.Node{
+				Node: "node-" + addr,
+			},
+			Service: &api.AgentService{
+				Address: addr,
+				Port:    50051,
+			},
+		}
+
+		if zone != "" {
+			e.Node.Meta = map[string]string{"az": zone}
+		}
+
+		return e
+	}
+
+	tt := []struct {
+		name   string
+		zone   string
+		in     []*api.ServiceEntry
+		expect []*api.ServiceEntry
+	}{
+		{
+			name:   "no services in zone",
+			zone:   "a",
+			in:     []*api.ServiceEntry{entry("b", "127.0.0.2"), entry("", "127.0.0.1")},
+			expect: []*api.ServiceEntry{entry("b", "127.0.0.2"), entry("", "127.0.0.1")},
+		},
+		{
+			name: "services in zone go first keeping order",
+			zone: "a",
+			in: []*api.ServiceEntry{
+				entry("b", "127.0.0.1"),
+				entry("a", "127.0.0.2"),
+				entry("", "127.0.0.3"),
+				entry("a", "127.0.0.4"),
+			},
+			expect: []*api.ServiceEntry{
+				entry("a", "127.0.0.2"),
+				entry("a", "127.0.0.4"),
+				entry("b", "127.0.0.1"),
+				entry("", "127.0.0.3"),
+			},
+		},
+		{
+			name:   "unknown zone",
+			in:     []*api.ServiceEntry{entry("b", "127.0.0.2"), entry("", "127.0.0.1")},
+			expect: []*api.ServiceEntry{entry("b", "127.0.0.2"), entry("", "127.0.0.1")},
+		},
+	}
+
+	for i := range tt {
+		tc := tt[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			sort.Stable(sameZoneFirst{
+				zoneKey: "az",
+				zone:    tc.zone,
+				in:      tc.in,
+			})
+
+			require.Equal(t, tc.expect, tc.in)
+		})
+	}
+}
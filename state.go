@@ -0,0 +1,92 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ServiceState describes the last successful query of the single service.
+type ServiceState struct {
+	// LastIndex is the Consul index of the response.
+	LastIndex uint64
+	// RequestTime is the duration of the request including the blocking wait.
+	RequestTime time.Duration
+	// FetchedAt is the time the response was received.
+	FetchedAt time.Time
+	// Instances is the number of instances returned by Consul.
+	Instances int
+	// Excluded are the instances in maintenance mode dropped by the resolver,
+	// keyed by 'node/service-id', with the reason of the exclusion.
+	Excluded map[string]string `json:",omitempty"`
+}
+
+// State is the introspection snapshot of the resolver.
+type State struct {
+	// Target is the target of the resolver with redacted secrets.
+	Target string
+	// Services is the state of every service of the target
+	// which has been fetched at least once, keyed by service name.
+	Services map[string]ServiceState
+}
+
+// State returns the introspection snapshot of the resolver.
+func (r *Resolver) State() State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	services := make(map[string]ServiceState, len(r.state))
+	for name, s := range r.state {
+		services[name] = s
+	}
+
+	return State{
+		Target:   r.t.String(),
+		Services: services,
+	}
+}
+
+// recordFetch updates the state of the service after the successful query.
+func (r *Resolver) recordFetch(service string, instances int, meta *api.QueryMeta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == nil {
+		r.state = make(map[string]ServiceState)
+	}
+
+	s := ServiceState{
+		FetchedAt: time.Now(),
+		Instances: instances,
+		Excluded:  r.state[service].Excluded,
+	}
+
+	if meta != nil {
+		s.LastIndex = meta.LastIndex
+		s.RequestTime = meta.RequestTime
+	}
+
+	r.state[service] = s
+}
+
+// recordExcluded replaces the excluded instances of the service and returns the previous ones.
+func (r *Resolver) recordExcluded(service string, excluded map[string]string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == nil {
+		r.state = make(map[string]ServiceState)
+	}
+
+	s := r.state[service]
+	previous := s.Excluded
+
+	s.Excluded = nil
+	if len(excluded) > 0 {
+		s.Excluded = excluded
+	}
+
+	r.state[service] = s
+
+	return previous
+}
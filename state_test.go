@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_State(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	mockConsul := NewMockConsul(ctrl)
+	mockConsul.EXPECT().ServiceMultipleTags("svc", nil, false, gomock.Any()).Return([]*api.ServiceEntry{
+		{Service: &api.AgentService{Address: "127.0.0.1", Port: 1}},
+		{Service: &api.AgentService{Address: "127.0.0.2", Port: 1}},
+	}, &api.QueryMeta{LastIndex: 42, RequestTime: 3 * time.Millisecond}, nil)
+
+	s := &Resolver{
+		logger:  noopLogger{},
+		metrics: noopMetrics{},
+		onError: func(error) {},
+		t: &Target{
+			Service: "svc",
+			Token:   "secret",
+		},
+		c: mockConsul,
+	}
+
+	require.Empty(t, s.State().Services)
+
+	_, err := s.Lookup(context.Background())
+	require.NoError(t, err)
+
+	state := s.State()
+	require.NotContains(t, state.Target, "secret")
+
+	svc := state.Services["svc"]
+	require.Equal(t, uint64(42), svc.LastIndex)
+	require.Equal(t, 3*time.Millisecond, svc.RequestTime)
+	require.Equal(t, 2, svc.Instances)
+	require.False(t, svc.FetchedAt.IsZero())
+}
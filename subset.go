@@ -0,0 +1,62 @@
+package consul
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// subset selects n entries using rendezvous hashing of the client ID
+// and the instance ID. Every client gets its own stable subset, instances
+// are spread evenly among clients, and when an instance comes or goes only
+// the subsets which contain it are changed. Entries keep their order.
+func subset(clientID string, entries []*api.ServiceEntry, n int) []*api.ServiceEntry {
+	if n <= 0 || len(entries) <= n {
+		return entries
+	}
+
+	scores := make([]uint64, len(entries))
+	idx := make([]int, len(entries))
+	for i, e := range entries {
+		scores[i] = rendezvousScore(clientID, instanceID(e))
+		idx[i] = i
+	}
+
+	sort.Slice(idx, func(i, j int) bool {
+		return scores[idx[i]] > scores[idx[j]]
+	})
+
+	selected := make([]bool, len(entries))
+	for _, i := range idx[:n] {
+		selected[i] = true
+	}
+
+	out := make([]*api.ServiceEntry, 0, n)
+	for i, e := range entries {
+		if selected[i] {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// rendezvousScore returns the weight of the instance for the client.
+func rendezvousScore(clientID string, id InstanceID) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(clientID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(id.String()))
+
+	// fnv has poor avalanche for similar inputs,
+	// so the sum is mixed with splitmix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
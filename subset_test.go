@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubset(t *testing.T) {
+	t.Parallel()
+
+	backends := func(n int) []*api.ServiceEntry {
+		entries := make([]*api.ServiceEntry, 0, n)
+		for i := 0; i < n; i++ {
+			entries = append(entries, &api.ServiceEntry{
+				Node:    &api.Node{Node: fmt.Sprintf("node-%d", i)},
+				Service: &api.AgentService{ID: "svc", Address: fmt.Sprintf("10.0.0.%d", i), Port: 8080},
+			})
+		}
+
+		return entries
+	}
+
+	t.Run("no subset", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, backends(3), subset("client", backends(3), 0))
+		require.Equal(t, backends(3), subset("client", backends(3), 3))
+	})
+
+	t.Run("deterministic and ordered", func(t *testing.T) {
+		t.Parallel()
+
+		got := subset("client", backends(10), 3)
+		require.Len(t, got, 3)
+		require.Equal(t, got, subset("client", backends(10), 3))
+
+		for i := 1; i < len(got); i++ {
+			require.Less(t, got[i-1].Node.Node, got[i].Node.Node)
+		}
+	})
+
+	t.Run("even spread", func(t *testing.T) {
+		t.Parallel()
+
+		const clients, size = 1000, 3
+
+		load := make(map[string]int)
+		for c := 0; c < clients; c++ {
+			for _, e := range subset(fmt.Sprintf("client-%d", c), backends(10), size) {
+				load[e.Node.Node]++
+			}
+		}
+
+		require.Len(t, load, 10)
+
+		// every backend should get about 300 clients
+		for node, n := range load {
+			require.InDelta(t, clients*size/10, n, 60, node)
+		}
+	})
+
+	t.Run("minimal churn", func(t *testing.T) {
+		t.Parallel()
+
+		all := backends(10)
+		removed := all[4]
+		rest := append(append([]*api.ServiceEntry{}, all[:4]...), all[5:]...)
+
+		for c := 0; c < 100; c++ {
+			id := fmt.Sprintf("client-%d", c)
+
+			before := subset(id, all, 3)
+			after := subset(id, rest, 3)
+
+			var hadRemoved bool
+			for _, e := range before {
+				hadRemoved = hadRemoved || e == removed
+			}
+
+			if !hadRemoved {
+				require.Equal(t, before, after, id)
+				continue
+			}
+
+			// only the removed backend is replaced
+			var kept int
+			for _, e := range after {
+				for _, b := range before {
+					if e == b {
+						kept++
+					}
+				}
+			}
+
+			require.Equal(t, 2, kept, id)
+		}
+	})
+}
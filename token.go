@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// TokenProvider returns the Consul ACL token for the request. It's called
+// before every request, so rotated tokens are picked up without rebuilding
+// gRPC channels.
+type TokenProvider func(ctx context.Context) (string, error)
+
+// tokenTransport sets the token returned by the provider on every request.
+type tokenTransport struct {
+	base  http.RoundTripper
+	token TokenProvider
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Consul token: %w", err)
+	}
+
+	// the request must not be modified by the transport
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Consul-Token", token)
+
+	return t.base.RoundTrip(req)
+}
+
+// withTokenProvider makes the client built from the config use the provider.
+func withTokenProvider(cfg *api.Config, p TokenProvider) *api.Config {
+	base := cfg.HttpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	cfg.Token = ""
+	cfg.HttpClient.Transport = &tokenTransport{base: base, token: p}
+
+	return cfg
+}
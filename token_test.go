@@ -0,0 +1,61 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTokenProvider(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("X-Consul-Token"))
+		mu.Unlock()
+
+		w.Header().Set("X-Consul-Index", "1")
+		_, _ = w.Write([]byte("[]"))
+	}))
+	t.Cleanup(srv.Close)
+
+	var calls int
+	provider := func(ctx context.Context) (string, error) {
+		calls++
+		if calls == 3 {
+			return "", errors.New("vault is sealed")
+		}
+
+		return fmt.Sprintf("token-%d", calls), nil
+	}
+
+	dsn := "consul://" + strings.TrimPrefix(srv.URL, "http://") + "/svc?token=static"
+	r, err := NewResolver(dsn, WithTokenProvider(provider))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = r.Lookup(context.Background())
+		require.NoError(t, err)
+	}
+
+	_, err = r.Lookup(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "vault is sealed")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, []string{"token-1", "token-2"}, tokens)
+}
@@ -0,0 +1,133 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+const defaultHealthTTL = 10 * time.Second
+
+// ttlCheckID returns ID of the TTL check mirroring the serving status of the instance.
+func ttlCheckID(serviceID string) string {
+	return serviceID + ":grpc-health"
+}
+
+// checkStatus maps the serving status onto the Consul check status.
+func checkStatus(s healthpb.HealthCheckResponse_ServingStatus) string {
+	if s == healthpb.HealthCheckResponse_SERVING {
+		return api.HealthPassing
+	}
+
+	return api.HealthCritical
+}
+
+// healthStream receives serving statuses from the health server in process.
+// There is no client behind it, so the metadata is dropped and nothing is received.
+type healthStream struct {
+	ctx      context.Context
+	statuses chan healthpb.HealthCheckResponse_ServingStatus
+}
+
+var _ healthpb.Health_WatchServer = (*healthStream)(nil)
+
+func (s *healthStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *healthStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *healthStream) SetTrailer(metadata.MD) {
+}
+
+func (s *healthStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *healthStream) Send(resp *healthpb.HealthCheckResponse) error {
+	select {
+	case s.statuses <- resp.Status:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *healthStream) SendMsg(m interface{}) error {
+	resp, ok := m.(*healthpb.HealthCheckResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message of gRPC health: %T", m)
+	}
+
+	return s.Send(resp)
+}
+
+func (s *healthStream) RecvMsg(interface{}) error {
+	return io.EOF
+}
+
+// bridgeHealth mirrors the serving status of the health service into
+// the TTL check until passed context is cancelled. The check is updated
+// immediately on the status change and on every heartbeat.
+func (g *Registrar) bridgeHealth(ctx context.Context) {
+	statuses := make(chan healthpb.HealthCheckResponse_ServingStatus)
+	go g.watchHealth(ctx, statuses)
+
+	ticker := time.NewTicker(g.ttl / 3)
+	defer ticker.Stop()
+
+	var (
+		status healthpb.HealthCheckResponse_ServingStatus
+		known  bool
+	)
+
+	for {
+		select {
+		case status = <-statuses:
+			known = true
+		case <-g.registered:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !known {
+			continue
+		}
+
+		output := fmt.Sprintf("gRPC health of '%s' is %s", g.healthService, status)
+		if err := g.c.agent.UpdateTTL(ttlCheckID(g.reg.ID), output, checkStatus(status)); err != nil {
+			g.c.logger.Errorf("[Consul resolver] Couldn't update TTL check of '%s'. target={%s}; error={%v}", g.reg.ID, g.c.target, err)
+			g.c.onError(fmt.Errorf("failed to update TTL check of '%s': %w", g.reg.ID, err))
+		}
+	}
+}
+
+// watchHealth sends serving statuses of the health service into
+// passed channel until passed context is cancelled.
+func (g *Registrar) watchHealth(ctx context.Context, statuses chan healthpb.HealthCheckResponse_ServingStatus) {
+	bck := newBackoff(g.c.maxBackoff)
+	stream := &healthStream{ctx: ctx, statuses: statuses}
+
+	for {
+		err := g.health.Watch(&healthpb.HealthCheckRequest{Service: g.healthService}, stream)
+		if ctx.Err() != nil {
+			return
+		}
+
+		g.c.logger.Errorf("[Consul resolver] Watch of gRPC health of '%s' has ended. target={%s}; error={%v}", g.reg.ID, g.c.target, err)
+
+		select {
+		case <-time.After(bck.NextBackOff()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
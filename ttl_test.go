@@ -0,0 +1,208 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRegistrar_BridgeHealth(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := health.NewServer()
+	srv.SetServingStatus("payments", healthpb.HealthCheckResponse_SERVING)
+
+	updates := make(chan string, 10)
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	mockAgent.EXPECT().UpdateTTL("payments-1:grpc-health", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_, _, status string) error {
+			updates <- status
+			return nil
+		}).AnyTimes()
+
+	g := &Registrar{
+		c: &agentClient{
+			logger:     noopLogger{},
+			onError:    func(error) {},
+			service:    "payments",
+			maxBackoff: time.Second,
+			agent:      mockAgent,
+		},
+		reg:           &api.AgentServiceRegistration{ID: "payments-1", Name: "payments"},
+		health:        srv,
+		healthService: "payments",
+		ttl:           time.Hour,
+		registered:    make(chan struct{}, 1),
+	}
+
+	go g.bridgeHealth(ctx)
+
+	require.Equal(t, api.HealthPassing, <-updates)
+
+	// the flip is reported without waiting for the heartbeat
+	srv.SetServingStatus("payments", healthpb.HealthCheckResponse_NOT_SERVING)
+	require.Equal(t, api.HealthCritical, <-updates)
+
+	// the check is updated right after the registration
+	g.registered <- struct{}{}
+	require.Equal(t, api.HealthCritical, <-updates)
+
+	srv.SetServingStatus("payments", healthpb.HealthCheckResponse_SERVING)
+	require.Equal(t, api.HealthPassing, <-updates)
+}
+
+// streamingHealthServer uses the whole stream API in Watch.
+type streamingHealthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (streamingHealthServer) Watch(_ *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if err := stream.SetHeader(metadata.Pairs("version", "1")); err != nil {
+		return err
+	}
+
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	stream.SetTrailer(metadata.Pairs("version", "1"))
+
+	if err := stream.RecvMsg(&healthpb.HealthCheckRequest{}); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unexpected error of RecvMsg: %w", err)
+	}
+
+	if err := stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}); err != nil {
+		return err
+	}
+
+	<-stream.Context().Done()
+
+	return stream.Context().Err()
+}
+
+func TestRegistrar_BridgeHealthStream(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	updates := make(chan string, 10)
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	mockAgent.EXPECT().UpdateTTL("payments-1:grpc-health", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_, _, status string) error {
+			updates <- status
+			return nil
+		}).AnyTimes()
+
+	g := &Registrar{
+		c: &agentClient{
+			logger:     noopLogger{},
+			onError:    func(error) {},
+			service:    "payments",
+			maxBackoff: time.Second,
+			agent:      mockAgent,
+		},
+		reg:           &api.AgentServiceRegistration{ID: "payments-1", Name: "payments"},
+		health:        streamingHealthServer{},
+		healthService: "payments",
+		ttl:           time.Hour,
+		registered:    make(chan struct{}, 1),
+	}
+
+	go g.bridgeHealth(ctx)
+
+	require.Equal(t, api.HealthPassing, <-updates)
+}
+
+func TestRegistrar_RunJoinsHealthBridge(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv := health.NewServer()
+	srv.SetServingStatus("payments", healthpb.HealthCheckResponse_SERVING)
+
+	// updating is set while the TTL check is being updated
+	var updating int32
+
+	ctrl := gomock.NewController(t)
+	mockAgent := NewMockAgent(ctrl)
+	mockAgent.EXPECT().ServiceRegister(gomock.Any()).Return(nil)
+	mockAgent.EXPECT().UpdateTTL("payments-1:grpc-health", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_, _, _ string) error {
+			atomic.StoreInt32(&updating, 1)
+			defer atomic.StoreInt32(&updating, 0)
+
+			// the update is in flight when the context is cancelled
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+
+			return nil
+		}).MinTimes(1)
+	mockAgent.EXPECT().ServiceDeregister("payments-1").
+		DoAndReturn(func(string) error {
+			require.Zero(t, atomic.LoadInt32(&updating), "deregistered while the TTL check is being updated")
+			return nil
+		})
+
+	g := &Registrar{
+		c: &agentClient{
+			logger:     noopLogger{},
+			onError:    func(error) {},
+			service:    "payments",
+			maxBackoff: time.Second,
+			agent:      mockAgent,
+		},
+		reg:           &api.AgentServiceRegistration{ID: "payments-1", Name: "payments"},
+		interval:      time.Hour,
+		health:        srv,
+		healthService: "payments",
+		ttl:           time.Hour,
+		registered:    make(chan struct{}, 1),
+	}
+
+	require.NoError(t, g.Run(ctx))
+}
+
+func TestNewRegistrar_HealthServer(t *testing.T) {
+	t.Parallel()
+
+	g, err := NewRegistrar("consul://127.0.0.1:8500/payments", Registration{
+		ID:           "payments-1",
+		Port:         50051,
+		HealthServer: health.NewServer(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, api.AgentServiceChecks{{
+		CheckID: "payments-1:grpc-health",
+		Name:    "gRPC health",
+		TTL:     "10s",
+	}}, g.reg.Checks)
+}
+
+func TestCheckStatus(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, api.HealthPassing, checkStatus(healthpb.HealthCheckResponse_SERVING))
+	require.Equal(t, api.HealthCritical, checkStatus(healthpb.HealthCheckResponse_NOT_SERVING))
+	require.Equal(t, api.HealthCritical, checkStatus(healthpb.HealthCheckResponse_SERVICE_UNKNOWN))
+}